@@ -0,0 +1,98 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/keyagent"
+)
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run an ssh-agent managed by encabulator",
+	Long: `Runs an ssh-agent that holds keys in memory, listening on a unix socket.
+The shell commands needed to use the agent are printed to stdout, in the same
+format as ssh-agent -s.
+
+Keys added with a lifetime (ssh-add -t) expire on time, and keys added with
+confirmation (ssh-add -c) ask for confirmation through SSH_ASKPASS before each
+use. PKCS#11 providers (ssh-add -s) are not supported.
+
+The agent can be restarted without killing it, dropping all of its keys. Send
+it SIGHUP, or run encabulator rekey --kill with SSH_AUTH_SOCK pointed at it.
+`,
+	Example: `  encabulator agent > ~/.encabulator/agent.env &
+  eval $(cat ~/.encabulator/agent.env)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyring := keyagent.NewKeyring()
+		keyring.DefaultLifetime = viper.GetDuration("agent.Lifetime")
+		keyring.OnRestart = func() {
+			if verbose {
+				fmt.Fprintln(os.Stderr, "Agent restarted")
+			}
+		}
+
+		server, err := keyagent.Listen(viper.GetString("agent.Socket"), keyring)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(keyagent.Exports(server.Path, os.Getpid()))
+
+		stopping := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			for sig := range signals {
+				if sig == syscall.SIGHUP {
+					keyring.Restart()
+					continue
+				}
+				close(stopping)
+				server.Close()
+				return
+			}
+		}()
+
+		err = server.Serve()
+		select {
+		case <-stopping:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(agentCmd)
+	viper.SetDefault("agent.Socket", keyagent.DefaultPath())
+
+	// --socket: where to listen
+	agentCmd.Flags().StringP("socket", "a", viper.GetString("agent.Socket"), "Path of the unix socket to listen on.")
+	viper.BindPFlag("agent.Socket", agentCmd.Flags().Lookup("socket"))
+
+	// --lifetime: default lifetime of added keys
+	agentCmd.Flags().DurationP("lifetime", "t", 0, "Default lifetime of keys added without one. Zero keeps keys until removed.")
+	viper.BindPFlag("agent.Lifetime", agentCmd.Flags().Lookup("lifetime"))
+}
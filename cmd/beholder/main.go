@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/justjake/encabulator/task"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var outPath string
 var statusPath string
+var grace time.Duration
 
 type supervisor struct {
 	cmd       *exec.Cmd
@@ -20,21 +25,49 @@ type supervisor struct {
 	status    io.Writer
 	startedAt time.Time
 	lastError error
+	stoppedBy string
 }
 
-func (sup *supervisor) Start() error {
+// Start spawns the program in its own process group. When ctx is done, the
+// group is sent SIGTERM, and then SIGKILL if it is still running after grace.
+func (sup *supervisor) Start(ctx context.Context, grace time.Duration) (*task.Task, error) {
 	sup.startedAt = time.Now()
-	sup.lastError = sup.cmd.Start()
+	t, err := task.SpawnPipesContext(ctx, sup.cmd, passThrough, passThrough)
+	if err != nil {
+		sup.lastError = err
+	} else {
+		t.Grace = grace
+	}
 	sup.WriteStatus()
-	return sup.lastError
+	return t, err
 }
 
-func (sup *supervisor) Wait() error {
-	sup.lastError = sup.cmd.Wait()
+// Wait copies the program's output until it ends.
+func (sup *supervisor) Wait(t *task.Task) error {
+	for event := range t.Output {
+		switch payload := event.Payload.(type) {
+		case *task.Output:
+			writeOk(io.WriteString(sup.output, payload.Chunk))
+		case *task.Ended:
+			sup.lastError = payload.Error
+			if payload.By != task.ByExit {
+				sup.stoppedBy = payload.By.String()
+			}
+		}
+	}
 	sup.WriteStatus()
 	return sup.lastError
 }
 
+// passThrough splits output into whatever chunks it is read in, so that it is
+// copied unchanged.
+func passThrough(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	return len(data), data, nil
+}
+
 func (sup *supervisor) WriteStatus() {
 	writeOk(sup.status.Write(snapshot(sup).Bytes()))
 }
@@ -50,11 +83,15 @@ type stat struct {
 	Elapsed    time.Duration
 	SystemTime time.Duration
 	UserTime   time.Duration
+	// StoppedBy is "signal" if the program exited after beholder was asked to
+	// stop it, or "kill" if it was killed after the grace period.
+	StoppedBy string `json:",omitempty"`
 }
 
 func snapshot(sup *supervisor) *stat {
 	result := &stat{
-		Elapsed: time.Now().Sub(sup.startedAt),
+		Elapsed:   time.Now().Sub(sup.startedAt),
+		StoppedBy: sup.stoppedBy,
 	}
 
 	if state := sup.cmd.ProcessState; state != nil {
@@ -100,6 +137,9 @@ Print the status of the execution to STDOUT or a file as newline-seperated JSON.
 This utility is intended to make it easy to gather the status of a long-running
 command once it has finished.
 
+When interrupted, the program and its children are sent SIGTERM, and then
+SIGKILL if they are still running after the grace period.
+
 Examples:
   # preview the sort of output you'll get
   %s echo hello world
@@ -118,6 +158,7 @@ func init() {
 	}
 	flag.StringVar(&outPath, "out", "", "Location to write out program output")
 	flag.StringVar(&statusPath, "status", "", "Location to write out program exit status")
+	flag.DurationVar(&grace, "grace", 5*time.Second, "How long the program has to exit when interrupted, before it is killed")
 	flag.Parse()
 }
 
@@ -149,8 +190,11 @@ func main() {
 	rest := args[1:]
 
 	cmd := exec.Command(name, rest...)
-	cmd.Stdout = output
-	cmd.Stderr = output
+	// the program gets no input, as if run in the background.
+	cmd.Stdin, err = os.Open(os.DevNull)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	sup := &supervisor{
 		cmd:    cmd,
@@ -158,11 +202,26 @@ func main() {
 		status: status,
 	}
 
-	if err := sup.Start(); err != nil {
+	// the context is done when beholder is interrupted. SIGHUP only counts if
+	// it isn't ignored, so that nohup keeps the program running.
+	ctx, cancel := context.WithCancel(context.Background())
+	stopSignals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	if !signal.Ignored(syscall.SIGHUP) {
+		stopSignals = append(stopSignals, syscall.SIGHUP)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stopSignals...)
+
+	t, err := sup.Start(ctx, grace)
+	if err != nil {
 		log.Fatalln(err)
 	}
+	go func() {
+		<-signals
+		cancel()
+	}()
 
-	if err := sup.Wait(); err != nil {
+	if err := sup.Wait(t); err != nil {
 		log.Fatalln(err)
 	}
 }
@@ -17,6 +17,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -28,9 +30,120 @@ var mapNameToRekey = map[string](func() *rekey.KeyEnsurer){
 	"yubikey": rekey.Yubikey,
 	"goldkey": rekey.Goldkey,
 	"id":      rekey.DefaultIdentity,
+	"gpgcard": rekey.GPGCard,
+	"fido":    rekey.SecurityKey,
 }
 var names = keys(mapNameToRekey)
 
+// configProfiles reads the profiles declared under rekey.Profiles in the
+// config file.
+func configProfiles() (map[string]*rekey.Profile, error) {
+	profiles := make(map[string]*rekey.Profile)
+	if err := viper.UnmarshalKey("rekey.Profiles", &profiles); err != nil {
+		return nil, err
+	}
+	for name, profile := range profiles {
+		profile.Name = name
+	}
+	return profiles, nil
+}
+
+// ensurerFor builds the KeyEnsurer for the named key type. Profiles from the
+// config file take precedence over the built-in types.
+func ensurerFor(name string) (*rekey.KeyEnsurer, error) {
+	profiles, err := configProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("Reading profiles from config: %v", err)
+	}
+	if profile, ok := profiles[name]; ok {
+		return profile.Ensurer()
+	}
+	if builtin, ok := mapNameToRekey[name]; ok {
+		return builtin(), nil
+	}
+	return nil, fmt.Errorf("Unknown type %s.", name)
+}
+
+// ensurersFor builds a KeyEnsurer for each named key type, in order. Repeated
+// names are only ensured once.
+func ensurersFor(names []string) ([]*rekey.KeyEnsurer, error) {
+	seen := make(map[string]bool)
+	ensurers := []*rekey.KeyEnsurer{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		svc, err := ensurerFor(name)
+		if err != nil {
+			return nil, err
+		}
+		ensurers = append(ensurers, svc)
+	}
+	return ensurers, configure(ensurers)
+}
+
+// hostEnsurers builds a KeyEnsurer for each key that ssh would use to connect
+// to destination, according to the ssh config. identities are extra identity
+// files, given to ssh with -i.
+func hostEnsurers(destination string, identities ...string) ([]*rekey.KeyEnsurer, error) {
+	host, err := rekey.LookupHost(destination, viper.GetStringSlice("rekey.SSHConfig")...)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range identities {
+		host.IdentityFiles = append(host.IdentityFiles, rekey.ExpandHome(path))
+	}
+	ensurers, err := host.Ensurers()
+	if err != nil {
+		return nil, err
+	}
+	return ensurers, configure(ensurers)
+}
+
+// runEnsurers builds the ensurers for --host, if the ssh config names keys for
+// it, and otherwise for --type.
+func runEnsurers(identities ...string) ([]*rekey.KeyEnsurer, error) {
+	if destination := viper.GetString("rekey.Host"); destination != "" {
+		ensurers, err := hostEnsurers(destination, identities...)
+		if err != nil || len(ensurers) > 0 {
+			return ensurers, err
+		}
+	}
+	return ensurersFor(viper.GetStringSlice("rekey.Type"))
+}
+
+// configure applies the settings shared by every KeyEnsurer.
+func configure(ensurers []*rekey.KeyEnsurer) error {
+	state, err := rekey.LoadState(rekey.DefaultStatePath())
+	if err != nil {
+		return err
+	}
+
+	lock := newLock()
+	for _, svc := range ensurers {
+		svc.ProbeTimeout = viper.GetDuration("rekey.Timeout")
+		svc.State = state
+		svc.RefreshBefore = viper.GetDuration("rekey.Refresh")
+		svc.Lock = lock
+		if !viper.GetBool("rekey.Force") {
+			svc.ProbeCacheTTL = viper.GetDuration("rekey.ProbeCache")
+		}
+		if viper.GetBool("rekey.VerifyPresence") {
+			svc.VerifyPresence = true
+		}
+	}
+	return nil
+}
+
+// newLock returns the lock that rekeys hold while loading keys, so that
+// concurrent runs ask for each PIN once.
+func newLock() *rekey.FileLock {
+	lock := rekey.NewFileLock(rekey.DefaultLockPath())
+	lock.Timeout = viper.GetDuration("rekey.LockTimeout")
+	return lock
+}
+
 // rekeyCmd represents the rekey command
 var rekeyCmd = &cobra.Command{
 	Use:   "rekey",
@@ -41,10 +154,86 @@ loaded into ssh-agent, rekey will ask you to add them.
 Rekey is handy when working with hardware tokens with short caching lifetimes.
 Add rekey to your aliases to ensure your commands always have the SSH keys that
 they need.
+
+The gpgcard type loads the key on an OpenPGP card through gpg-agent, for use
+with gpg-agent's ssh support.
+
+The fido type loads the resident keys of FIDO security keys (sk-ssh-ed25519 and
+sk-ecdsa keys) with "ssh-add -K". Signing with them needs a touch, so rekey
+only checks that they are listed in the agent. With --verify-presence, or
+verifyPresence: true in a profile, rekey signs with them too, and waits up to
+--timeout for the touch. A key that isn't touched is reported as needing
+presence, and isn't loaded again.
+
+Without a TTY, for example in git hooks or editors, rekey asks for PINs with
+the program in SSH_ASKPASS, or with pinentry.
+
+Pass --type several times, or set rekey.type to a list in the config file, to
+ensure several keys at once. Keys are loaded in the order they are given.
+
+Besides the built-in types, you can declare your own key profiles in
+~/.encabulator.yaml and pass their names to --type:
+
+  rekey:
+    modulePath: [~/lib/pkcs11]     # searched first for PKCS#11 modules
+    profiles:
+      work:
+        match:
+          comment: libykcs11         # regexp matched against the key comment
+          fingerprints: [SHA256:...] # as printed by ssh-add -l
+          authorizedkeys: ~/.ssh/id_work.pub
+          type: ecdsa-sha2-nistp256
+          # securityKey: true        # any FIDO security key
+        load:
+          pkcs11: libykcs11          # or a path to the module
+          # or file: ~/.ssh/id_work
+          # or keys: [~/.ssh/id_work*]   # loaded without ssh-add
+          #    confirm: true             # confirm each use of keys
+          # or gpgagent: true            # an OpenPGP card in gpg-agent
+          # or resident: true            # FIDO resident keys, ssh-add -K
+          # or command: [my-loader, --flag]
+        lifetime: 4h
+        # verifyPresence: true     # sign with security keys, with a touch
+        certificate:               # require an OpenSSH certificate
+          principals: [deploy]
+          minValidity: 10m         # renew certificates about to expire
+          ca: ~/.ssh/ca            # issue it with this CA key, or else
+          key: ~/.ssh/id_work      # have the load rule issue it
+          validity: 8h
+
+Run "encabulator rekey doctor" to see which PKCS#11 modules can be found.
+
+ssh-agent doesn't say when a key expires, so rekey records when it loads each
+key in ~/.encabulator/rekey-state.json. Keys that expire within --refresh are
+loaded again, so they don't vanish in the middle of your work.
+
+Checking a key makes the token sign, which may need a touch. With
+--probe-cache, a key that signed within that duration is only checked for in
+the agent's key list. Pass --force to sign anyway.
+
+With --host, rekey reads ~/.ssh/config and /etc/ssh/ssh_config, including
+their Host and Match blocks and Includes, to find the keys ssh will use for
+that host: its IdentityFiles, with their CertificateFiles, and its
+PKCS11Provider. If the config names no keys for the host, --type is used.
+
+When several rekeys run at once, for example from parallel git fetches, only
+one of them loads the keys. The others wait up to --lock-timeout for it to
+finish, and then check the agent again.
 `,
 	Example: `  encabulator rekey --type=id && ssh foo@example.com
-  encabulator rekey && git pull`,
+  eval $(encabulator rekey --kill)
+  encabulator rekey && git pull
+  encabulator rekey --type=yubikey --type=id && git push
+  encabulator rekey --any --type=yubikey,goldkey && git push
+  encabulator rekey --host=git@github.com && git push`,
 	ValidArgs: names,
+	// settings shared with subcommands
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		rekey.PinentryProgram = viper.GetString("rekey.Pinentry")
+		if dirs := viper.GetStringSlice("rekey.ModulePath"); len(dirs) > 0 {
+			rekey.ModuleSearchPath = append(dirs, rekey.DefaultModuleSearchPath()...)
+		}
+	},
 	// check to see if arguments are copacetic
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		// no args
@@ -52,24 +241,19 @@ they need.
 			return fmt.Errorf("Unknown arguments %v", args)
 		}
 
-		// type must be valid
-		name := viper.GetString("rekey.Type")
-		if _, ok := mapNameToRekey[name]; !ok {
-			return fmt.Errorf("Unknown type %s.", name)
-		}
-
-		return nil
+		// types and the ssh config must be valid
+		_, err := runEnsurers()
+		return err
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		kill := viper.GetBool("rekey.KillAgent")
-		name := viper.GetString("rekey.Type")
-
-		loader := mapNameToRekey[name]()
-		if kill {
-			loader = rekey.EnsureRestartingAgent(loader)
+		report, env, err := ensureKeys(viper.GetBool("rekey.KillAgent"))
+		if env != nil {
+			// started a new agent: tell the shell where to find it.
+			fmt.Print(env.Shell())
+		}
+		if report != nil && (verbose || err != nil || len(report.Loaded) > 0) {
+			fmt.Fprintln(os.Stderr, report)
 		}
-
-		err := loader.EnsureLoaded()
 		if err != nil {
 			fmt.Printf("Error: %s\n", err)
 			os.Exit(1)
@@ -77,6 +261,45 @@ they need.
 	},
 }
 
+// ensureKeys loads the keys for --host or --type, restarting the agent first
+// if kill is set. If a new agent was started, its environment is returned.
+// identities are extra identity files for --host.
+func ensureKeys(kill bool, identities ...string) (*rekey.Report, *rekey.AgentEnv, error) {
+	ensurers, err := runEnsurers(identities...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mode := rekey.AllOf
+	if viper.GetBool("rekey.Any") {
+		mode = rekey.AnyOf
+	}
+	group := rekey.NewGroup(mode, ensurers...)
+	group.Lock = newLock()
+	restarter := &rekey.AgentRestarter{}
+	if kill {
+		group.Restart = restarter.Restart
+	}
+
+	report, err := group.Ensure()
+	return report, restarter.Env, err
+}
+
+// allEnsurers builds a KeyEnsurer for every built-in type and configured
+// profile, sorted by name.
+func allEnsurers() ([]*rekey.KeyEnsurer, error) {
+	profiles, err := configProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("Reading profiles from config: %v", err)
+	}
+	all := append([]string{}, names...)
+	for name := range profiles {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	return ensurersFor(all)
+}
+
 func keys(m map[string]func() *rekey.KeyEnsurer) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
@@ -89,12 +312,53 @@ func init() {
 	RootCmd.AddCommand(rekeyCmd)
 	viper.SetDefault("rekey.Type", "yubikey")
 	viper.SetDefault("rekey.Kill", true)
+	viper.SetDefault("rekey.Pinentry", rekey.PinentryProgram)
 
 	// --type: type of flag
-	rekeyCmd.Flags().StringP("type", "t", viper.GetString("rekey.Type"), fmt.Sprintf("Type of key to load. One of %v.", names))
-	viper.BindPFlag("rekey.Type", rekeyCmd.Flags().Lookup("type"))
+	rekeyCmd.PersistentFlags().StringSliceP("type", "t", []string{viper.GetString("rekey.Type")}, fmt.Sprintf("Type of key to load. One of %v, or a profile from the config file. Repeat to load several keys, in order.", names))
+	viper.BindPFlag("rekey.Type", rekeyCmd.PersistentFlags().Lookup("type"))
 
 	// --kill: kill agent before attempting to load keys
-	rekeyCmd.Flags().BoolP("kill", "k", viper.GetBool("rekey.Kill"), "Kill ssh-agent before loading any keys. This is useful on macOS.")
-	viper.BindPFlag("rekey.KillAgent", rekeyCmd.Flags().Lookup("kill"))
+	rekeyCmd.PersistentFlags().BoolP("kill", "k", viper.GetBool("rekey.Kill"), "Restart the ssh-agent behind SSH_AUTH_SOCK before loading any keys. If a new agent is started, its environment is printed for eval. rekey exec only restarts it when --kill is given.")
+	viper.BindPFlag("rekey.KillAgent", rekeyCmd.PersistentFlags().Lookup("kill"))
+
+	// --timeout: how long to wait for the agent
+	rekeyCmd.PersistentFlags().Duration("timeout", rekey.DefaultProbeTimeout, "How long to wait for ssh-agent to sign with a key, including waiting for a touch.")
+	viper.BindPFlag("rekey.Timeout", rekeyCmd.PersistentFlags().Lookup("timeout"))
+
+	// --pinentry: how to ask for PINs without a TTY
+	rekeyCmd.PersistentFlags().String("pinentry", viper.GetString("rekey.Pinentry"), "Pinentry program used to ask for PINs when there is no TTY and SSH_ASKPASS is unset.")
+	viper.BindPFlag("rekey.Pinentry", rekeyCmd.PersistentFlags().Lookup("pinentry"))
+
+	// --refresh: reload keys that are about to expire
+	rekeyCmd.PersistentFlags().Duration("refresh", 10*time.Minute, "Load keys again if they expire within this duration. 0 disables refreshing.")
+	viper.BindPFlag("rekey.Refresh", rekeyCmd.PersistentFlags().Lookup("refresh"))
+
+	// --lock-timeout: how long to wait for another rekey
+	rekeyCmd.PersistentFlags().Duration("lock-timeout", rekey.DefaultLockTimeout, "How long to wait for another rekey that is loading keys.")
+	viper.BindPFlag("rekey.LockTimeout", rekeyCmd.PersistentFlags().Lookup("lock-timeout"))
+
+	// --probe-cache: skip signing keys that signed recently
+	rekeyCmd.PersistentFlags().Duration("probe-cache", 0, "Only list keys, without signing, if they signed within this duration. 0 always signs.")
+	viper.BindPFlag("rekey.ProbeCache", rekeyCmd.PersistentFlags().Lookup("probe-cache"))
+
+	// --force: ignore the probe cache
+	rekeyCmd.PersistentFlags().Bool("force", false, "Sign with each key, even if --probe-cache would skip it.")
+	viper.BindPFlag("rekey.Force", rekeyCmd.PersistentFlags().Lookup("force"))
+
+	// --verify-presence: sign with security keys too
+	rekeyCmd.PersistentFlags().Bool("verify-presence", false, "Sign with FIDO security keys when checking them, which needs a touch, instead of only checking that they are listed.")
+	viper.BindPFlag("rekey.VerifyPresence", rekeyCmd.PersistentFlags().Lookup("verify-presence"))
+
+	// --host: load the keys ssh uses for a host
+	rekeyCmd.PersistentFlags().String("host", "", "Load the keys that ssh's config names for this host or user@host, instead of --type.")
+	viper.BindPFlag("rekey.Host", rekeyCmd.PersistentFlags().Lookup("host"))
+
+	// --ssh-config: where to read ssh's config
+	rekeyCmd.PersistentFlags().StringSlice("ssh-config", rekey.SSHConfigFiles, "ssh config files to read for --host.")
+	viper.BindPFlag("rekey.SSHConfig", rekeyCmd.PersistentFlags().Lookup("ssh-config"))
+
+	// --any: only one of the types needs to be loaded
+	rekeyCmd.PersistentFlags().Bool("any", false, "Succeed if any one of the given types is loaded, instead of all of them.")
+	viper.BindPFlag("rekey.Any", rekeyCmd.PersistentFlags().Lookup("any"))
 }
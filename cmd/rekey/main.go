@@ -9,6 +9,10 @@ import (
 // TODO: add help
 // TODO: add support for goldkey
 func main() {
+	if rekey.IsAskpass() {
+		os.Exit(rekey.RunAskpass(os.Args[1:]))
+	}
+
 	yk := rekey.EnsureRestartingAgent(rekey.Yubikey())
 	err := yk.EnsureLoaded()
 
@@ -0,0 +1,71 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/justjake/encabulator/rekey"
+)
+
+// rekeyDoctorCmd represents the rekey doctor command
+var rekeyDoctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that rekey can load your keys",
+	Long: `Checks that ssh-add is installed, that the agent behind SSH_AUTH_SOCK
+answers, whether gpg-connect-agent is installed, and how PINs will be asked
+for. Then reports which PKCS#11 modules can be found in the module search
+path.
+
+Modules used by profiles in the config file must be found. Modules for the
+built-in types are reported, but missing ones aren't an error.
+
+Modules are searched for in these directories, after any listed under
+rekey.modulePath in the config file:
+
+  ` + fmt.Sprint(rekey.DefaultModuleSearchPath()),
+	Example: `  encabulator rekey doctor`,
+	Run: func(cmd *cobra.Command, args []string) {
+		profiles, err := configProfiles()
+		if err != nil {
+			fmt.Printf("Error: Reading profiles from config: %s\n", err)
+			os.Exit(1)
+		}
+		modules := []string{}
+		for _, profile := range profiles {
+			if profile.Load.PKCS11 != "" {
+				modules = append(modules, profile.Load.PKCS11)
+			}
+		}
+		sort.Strings(modules)
+
+		diagnosis := rekey.Doctor(modules)
+		if err := diagnosis.Print(os.Stdout); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		if !diagnosis.OK() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyDoctorCmd)
+}
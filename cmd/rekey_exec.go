@@ -0,0 +1,162 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// rekeyExecCmd represents the rekey exec command
+var rekeyExecCmd = &cobra.Command{
+	Use:   "exec -- command [args...]",
+	Short: "Ensure your keys are loaded, then run a command",
+	Long: `Loads the given types of keys like rekey does, then replaces itself with
+the command, which keeps rekey's arguments, stdio, and exit code.
+
+rekey's messages go to stderr, so exec can wrap programs that speak a protocol
+over stdout, like ssh for git. If the keys can't be loaded, the error is printed
+and the command runs anyway.
+
+Unlike rekey, exec doesn't restart the agent unless --kill is given. The
+command always sees a restarted agent, but your shell has to be pointed at it
+with the printed environment.
+
+When the command is ssh, the keys are picked from the ssh config for the host
+it connects to, as if by --host. ssh's -F, -i, and -l options are followed.
+
+Use "encabulator rekey install" to run every git command's ssh through exec.`,
+	Example: `  encabulator rekey exec -- ssh foo@example.com
+  encabulator rekey exec --type=yubikey -- git push
+  GIT_SSH_COMMAND="encabulator rekey exec -- ssh" git pull`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(127)
+		}
+
+		identities := []string{}
+		if filepath.Base(args[0]) == "ssh" && viper.GetString("rekey.Host") == "" {
+			ssh := parseSSHArgs(args[1:])
+			viper.Set("rekey.Host", ssh.Destination)
+			if ssh.Config != "" {
+				viper.Set("rekey.SSHConfig", []string{ssh.Config})
+			}
+			identities = ssh.Identities
+		}
+
+		// the command's stdout may carry a protocol: send anything loaders
+		// print to stderr instead.
+		os.Stdout = os.Stderr
+		// restarting the agent would leave the calling shell pointing at a dead
+		// one, so exec only restarts it when asked to.
+		kill := cmd.Flags().Changed("kill") && viper.GetBool("rekey.KillAgent")
+		report, env, err := ensureKeys(kill, identities...)
+		if env != nil {
+			fmt.Fprintf(os.Stderr, "Started a new ssh-agent. Point your shell at it with:\n%s", env.Shell())
+		}
+		if report != nil && (verbose || err != nil || len(report.Loaded) > 0) {
+			fmt.Fprintln(os.Stderr, report)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		}
+
+		// a restarted agent's environment was set in os.Environ.
+		err = syscall.Exec(path, args, os.Environ())
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(126)
+	},
+}
+
+// sshOptionsWithArgs are the options of ssh that take an argument.
+const sshOptionsWithArgs = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// sshArgs are the parts of an ssh command line that decide which keys it uses.
+type sshArgs struct {
+	// Destination is user@host, or host.
+	Destination string
+	// Config is the file given with -F.
+	Config string
+	// Identities are the files given with -i.
+	Identities []string
+}
+
+// parseSSHArgs finds the destination and key options in ssh's arguments.
+func parseSSHArgs(args []string) sshArgs {
+	parsed := sshArgs{}
+	user := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				parsed.Destination = args[i+1]
+			}
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			parsed.Destination = arg
+			break
+		}
+
+		// options may be grouped, like -vvi key, and an argument may be
+		// attached, like -ikey.
+		for j := 1; j < len(arg); j++ {
+			if !strings.ContainsRune(sshOptionsWithArgs, rune(arg[j])) {
+				continue
+			}
+			value := arg[j+1:]
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			switch arg[j] {
+			case 'F':
+				parsed.Config = value
+			case 'i':
+				parsed.Identities = append(parsed.Identities, value)
+			case 'l':
+				user = value
+			}
+			break
+		}
+	}
+
+	destination := strings.TrimPrefix(parsed.Destination, "ssh://")
+	if destination != parsed.Destination {
+		// ssh://[user@]host[:port]
+		if colon := strings.LastIndex(destination, ":"); colon > strings.LastIndex(destination, "@") {
+			destination = destination[:colon]
+		}
+	}
+	if user != "" && !strings.Contains(destination, "@") {
+		destination = user + "@" + destination
+	}
+	parsed.Destination = destination
+	return parsed
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyExecCmd)
+}
@@ -0,0 +1,41 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/justjake/encabulator/assert"
+)
+
+func TestParseSSHArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want sshArgs
+	}{
+		{[]string{"-vvi", "key", "host"}, sshArgs{Destination: "host", Identities: []string{"key"}}},
+		{[]string{"-ikey", "-i", "other", "host", "uptime"}, sshArgs{Destination: "host", Identities: []string{"key", "other"}}},
+		{[]string{"-l", "user", "host"}, sshArgs{Destination: "user@host"}},
+		{[]string{"-l", "user", "admin@host"}, sshArgs{Destination: "admin@host"}},
+		{[]string{"-F", "config", "-p", "2222", "--", "host"}, sshArgs{Destination: "host", Config: "config"}},
+		{[]string{"--", "-host"}, sshArgs{Destination: "-host"}},
+		{[]string{"ssh://user@host:22"}, sshArgs{Destination: "user@host"}},
+		{[]string{"-luser", "ssh://host"}, sshArgs{Destination: "user@host"}},
+		{[]string{"-v"}, sshArgs{}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, parseSSHArgs(test.args), test.want)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/keyagent"
+	"github.com/justjake/encabulator/rekey"
+)
+
+// rekeyFilterCmd represents the rekey filter command
+var rekeyFilterCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "Serve an agent socket that only exposes some of your keys",
+	Long: `Listens on a unix socket and forwards requests to the ssh-agent behind
+SSH_AUTH_SOCK, but only lists and signs with the keys of the given types. Other
+keys, like the ones on your token, stay hidden. Requests that change the agent
+are refused.
+
+Forward the filter instead of your agent to hosts you don't fully trust, such
+as shared build boxes. The shell commands to point SSH_AUTH_SOCK at it are
+printed to stdout. Each signature is logged to stderr, with the key's
+fingerprint and the process that asked for it. With --confirm, each signature
+must also be confirmed with SSH_ASKPASS.
+
+Policies for each socket can be declared in ~/.encabulator.yaml and served with
+--policy:
+
+  rekey:
+    filters:
+      buildbox:
+        socket: ~/.encabulator/buildbox.sock
+        allow:                     # like a profile's match
+          comment: ^deploy@
+          # all: true              # required to allow every key
+        confirm: true
+
+A policy whose allow rule is empty, for example because of a misspelled key, is
+refused rather than exposing every key.`,
+	Example: `  encabulator rekey filter --type=id --socket=/tmp/id.sock &
+  SSH_AUTH_SOCK=/tmp/id.sock ssh -A build.example.com
+  encabulator rekey filter --policy=buildbox`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, filter, err := filterPolicy()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		path, _ = filepath.Abs(path)
+		if path == os.Getenv(rekey.SSHAuthSock) {
+			fmt.Printf("Error: %s is the filter socket %s. Set it to the real agent's socket.\n", rekey.SSHAuthSock, path)
+			os.Exit(1)
+		}
+
+		server, err := keyagent.Listen(path, filter)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		server.AgentFor = filter.ForConn
+		fmt.Print(keyagent.Exports(server.Path, 0))
+
+		stopping := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stopping)
+			server.Close()
+		}()
+
+		err = server.Serve()
+		select {
+		case <-stopping:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// filterPolicy returns the socket path and Filter for the policy named by
+// --policy, or else for the keys of the given types.
+func filterPolicy() (string, *rekey.Filter, error) {
+	if name := viper.GetString("rekey.filter.Policy"); name != "" {
+		policies := make(map[string]*rekey.FilterPolicy)
+		if err := viper.UnmarshalKey("rekey.Filters", &policies); err != nil {
+			return "", nil, fmt.Errorf("Reading filter policies from config: %v", err)
+		}
+		policy, ok := policies[name]
+		if !ok {
+			return "", nil, fmt.Errorf("No filter policy %s in the config file", name)
+		}
+		policy.Name = name
+		if policy.Socket == "" {
+			policy.Socket = filepath.Join(filepath.Dir(keyagent.DefaultPath()), "filter-"+name+".sock")
+		}
+		filter, err := policy.Filter()
+		return rekey.ExpandHome(policy.Socket), filter, err
+	}
+
+	ensurers, err := runEnsurers()
+	if err != nil {
+		return "", nil, err
+	}
+	predicates := []rekey.Predicate{}
+	for _, svc := range ensurers {
+		predicates = append(predicates, svc.KeyPredicate)
+	}
+	filter := rekey.NewFilter(rekey.Or(predicates...))
+	if viper.GetBool("rekey.filter.Confirm") {
+		filter.Confirm = keyagent.AskpassConfirm
+	}
+	return viper.GetString("rekey.filter.Socket"), filter, nil
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyFilterCmd)
+	viper.SetDefault("rekey.filter.Socket", filepath.Join(filepath.Dir(keyagent.DefaultPath()), "rekey-filter.sock"))
+
+	// --socket: where to listen
+	rekeyFilterCmd.Flags().StringP("socket", "a", viper.GetString("rekey.filter.Socket"), "Path of the unix socket to listen on.")
+	viper.BindPFlag("rekey.filter.Socket", rekeyFilterCmd.Flags().Lookup("socket"))
+
+	// --confirm: confirm each signature
+	rekeyFilterCmd.Flags().Bool("confirm", false, "Confirm each signature with SSH_ASKPASS.")
+	viper.BindPFlag("rekey.filter.Confirm", rekeyFilterCmd.Flags().Lookup("confirm"))
+
+	// --policy: a policy from the config file
+	rekeyFilterCmd.Flags().String("policy", "", "Serve this filter policy from the config file, instead of the keys of --type.")
+	viper.BindPFlag("rekey.filter.Policy", rekeyFilterCmd.Flags().Lookup("policy"))
+}
@@ -0,0 +1,36 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	agents "golang.org/x/crypto/ssh/agent"
+
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+)
+
+func TestFilterPolicy_TypeHidesOtherKeys(t *testing.T) {
+	defer viper.Set("rekey.Type", viper.Get("rekey.Type"))
+	viper.Set("rekey.Type", []string{"id"})
+
+	_, filter, err := filterPolicy()
+	assert.Equal(t, err, nil)
+	token := rekeytest.PublicKey(rekeytest.GenerateKey("yubikey piv"))
+	listed := &agents.Key{Format: token.Type(), Blob: token.Marshal(), Comment: "yubikey piv"}
+	assert.Equal(t, filter.Allow(listed), false)
+}
@@ -0,0 +1,141 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// execMarker identifies an ssh command installed by rekey install.
+const execMarker = " rekey exec "
+
+var (
+	installGlobal bool
+	installUnset  bool
+)
+
+// rekeyInstallCmd represents the rekey install command
+var rekeyInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Make git load your keys before it uses ssh",
+	Long: `Sets git's core.sshCommand so that git runs ssh through "encabulator rekey
+exec". Every fetch, pull, and push then loads your keys first, without the
+aliases from the README.
+
+The setting is made in the current repository, or for your user with --global.
+The --type and --any flags given to install are passed on to exec. If
+core.sshCommand was already set, for example to "ssh -i ~/.ssh/id_work", that
+command is wrapped instead of plain ssh.`,
+	Example: `  encabulator rekey install --global --type=yubikey
+  encabulator rekey install --unset`,
+	Run: func(cmd *cobra.Command, args []string) {
+		scope := []string{"--local"}
+		if installGlobal {
+			scope = []string{"--global"}
+		}
+
+		if err := installSSHCommand(scope, execCommand(cmd), installUnset); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// installSSHCommand wraps core.sshCommand in the given scope with execCmd, or
+// with unset, restores the command it wrapped.
+func installSSHCommand(scope []string, execCmd string, unset bool) error {
+	current := gitConfigGet(scope, "core.sshCommand")
+	ssh := current
+	if strings.Contains(current, execMarker) {
+		// installed before: keep the command it wraps.
+		i := strings.Index(current, " -- ")
+		if i == -1 {
+			return fmt.Errorf("core.sshCommand %q runs rekey exec, but not with \" -- \" before an ssh command", current)
+		}
+		ssh = current[i+len(" -- "):]
+	}
+
+	if unset {
+		if ssh == "" || ssh == "ssh" {
+			return gitConfig(append(scope, "--unset", "core.sshCommand")...)
+		}
+		return gitConfig(append(scope, "core.sshCommand", ssh)...)
+	}
+	if ssh == "" {
+		ssh = "ssh"
+	}
+	return gitConfig(append(scope, "core.sshCommand", execCmd+" -- "+ssh)...)
+}
+
+// execCommand returns the shell command that runs rekey exec with the same
+// config and key types as this invocation.
+func execCommand(cmd *cobra.Command) string {
+	self, err := os.Executable()
+	if err != nil {
+		self = "encabulator"
+	}
+	argv := []string{shellQuote(self)}
+	if cfgFile != "" {
+		path, _ := filepath.Abs(cfgFile)
+		argv = append(argv, "--config", shellQuote(path))
+	}
+	argv = append(argv, "rekey", "exec")
+	if cmd.Flags().Changed("type") {
+		argv = append(argv, "--type="+shellQuote(strings.Join(viper.GetStringSlice("rekey.Type"), ",")))
+	}
+	if viper.GetBool("rekey.Any") {
+		argv = append(argv, "--any")
+	}
+	return strings.Join(argv, " ")
+}
+
+// shellQuote quotes s for sh, which git uses to run core.sshCommand.
+func shellQuote(s string) string {
+	if strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-,=+:") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func gitConfigGet(scope []string, key string) string {
+	out, _ := exec.Command("git", append(append([]string{"config"}, scope...), "--get", key)...).Output()
+	return strings.TrimSpace(string(out))
+}
+
+func gitConfig(args ...string) error {
+	cmd := exec.Command("git", append([]string{"config"}, args...)...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git config %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyInstallCmd)
+
+	// --global: configure git for the user, instead of this repository
+	rekeyInstallCmd.Flags().BoolVar(&installGlobal, "global", false, "Set core.sshCommand in your global git config, instead of the current repository's.")
+
+	// --unset: undo install
+	rekeyInstallCmd.Flags().BoolVar(&installUnset, "unset", false, "Stop running ssh through rekey, restoring any command it wrapped.")
+}
@@ -0,0 +1,66 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/justjake/encabulator/assert"
+)
+
+func TestInstallSSHCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "init", "-q").Run(); err != nil {
+		t.Skipf("git init: %v", err)
+	}
+
+	local := []string{"--local"}
+	execCmd := "encabulator rekey exec"
+	assert.Equal(t, installSSHCommand(local, execCmd, false), nil)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "encabulator rekey exec -- ssh")
+	// installing again doesn't wrap exec in itself.
+	assert.Equal(t, installSSHCommand(local, execCmd+" --any", false), nil)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "encabulator rekey exec --any -- ssh")
+	assert.Equal(t, installSSHCommand(local, execCmd, true), nil)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "")
+
+	// a command set before install is wrapped, and restored by --unset.
+	assert.Equal(t, gitConfig("--local", "core.sshCommand", "ssh -i ~/.ssh/id_work"), nil)
+	assert.Equal(t, installSSHCommand(local, execCmd, false), nil)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "encabulator rekey exec -- ssh -i ~/.ssh/id_work")
+	assert.Equal(t, installSSHCommand(local, execCmd, true), nil)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "ssh -i ~/.ssh/id_work")
+
+	// exec without " -- " doesn't say which command it wraps.
+	assert.Equal(t, gitConfig("--local", "core.sshCommand", "encabulator rekey exec ssh"), nil)
+	assert.Equal(t, installSSHCommand(local, execCmd, false) != nil, true)
+	assert.Equal(t, installSSHCommand(local, execCmd, true) != nil, true)
+	assert.Equal(t, gitConfigGet(local, "core.sshCommand"), "encabulator rekey exec ssh")
+}
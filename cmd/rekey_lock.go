@@ -0,0 +1,92 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/justjake/encabulator/rekey"
+)
+
+// rekeyLockCmd represents the rekey lock command
+var rekeyLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Lock ssh-agent with a passphrase",
+	Long: `Locks the agent behind SSH_AUTH_SOCK, like "ssh-add -x". A locked agent
+lists no keys and refuses to sign until it is unlocked with the same
+passphrase by "encabulator rekey unlock".
+
+The passphrase is asked for on the terminal, or else with SSH_ASKPASS or
+pinentry.`,
+	Example: `  encabulator rekey lock
+  encabulator rekey unload --type=yubikey && encabulator rekey lock`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := lockAgent(); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// rekeyUnlockCmd represents the rekey unlock command
+var rekeyUnlockCmd = &cobra.Command{
+	Use:     "unlock",
+	Short:   "Unlock ssh-agent",
+	Long:    `Unlocks the agent behind SSH_AUTH_SOCK, like "ssh-add -X".`,
+	Example: `  encabulator rekey unlock && encabulator rekey`,
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase, err := promptLockPassphrase("Enter lock passphrase")
+		if err == nil {
+			err = rekey.UnlockAgent(passphrase)
+		}
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// lockAgent asks for a passphrase twice, and locks the agent with it.
+func lockAgent() error {
+	passphrase, err := promptLockPassphrase("Enter lock passphrase")
+	if err != nil {
+		return err
+	}
+	again, err := promptLockPassphrase("Enter lock passphrase again")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return fmt.Errorf("Passphrases do not match")
+	}
+	return rekey.LockAgent(passphrase)
+}
+
+func promptLockPassphrase(description string) ([]byte, error) {
+	prompter, err := rekey.NewPrompter()
+	if err != nil {
+		return nil, err
+	}
+	return prompter.Prompt(description)
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyLockCmd)
+	rekeyCmd.AddCommand(rekeyUnlockCmd)
+}
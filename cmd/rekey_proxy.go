@@ -0,0 +1,99 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/keyagent"
+	"github.com/justjake/encabulator/rekey"
+)
+
+// rekeyProxyCmd represents the rekey proxy command
+var rekeyProxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Serve an agent socket that loads keys on demand",
+	Long: `Listens on a unix socket and forwards every request to the ssh-agent behind
+SSH_AUTH_SOCK. When a program lists keys or asks for a signature, and one of
+the given types of keys is missing, the proxy loads it first.
+
+Point SSH_AUTH_SOCK at the proxy to load keys for every program that talks to
+the agent, not just the ones you alias through rekey. The shell commands to do
+so are printed to stdout.
+
+Without a TTY, PINs are requested with SSH_ASKPASS or pinentry.`,
+	Example: `  encabulator rekey proxy --type=yubikey > ~/.encabulator/proxy.env &
+  eval $(cat ~/.encabulator/proxy.env)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ensurers, err := runEnsurers()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		path, _ := filepath.Abs(viper.GetString("rekey.proxy.Socket"))
+		if path == os.Getenv(rekey.SSHAuthSock) {
+			fmt.Printf("Error: %s is the proxy socket %s. Set it to the real agent's socket.\n", rekey.SSHAuthSock, path)
+			os.Exit(1)
+		}
+
+		proxy := rekey.NewProxy(ensurers...)
+		proxy.Cooldown = viper.GetDuration("rekey.proxy.Cooldown")
+		server, err := keyagent.Listen(path, proxy)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(keyagent.Exports(server.Path, 0))
+
+		stopping := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stopping)
+			server.Close()
+		}()
+
+		err = server.Serve()
+		select {
+		case <-stopping:
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyProxyCmd)
+	viper.SetDefault("rekey.proxy.Socket", filepath.Join(filepath.Dir(keyagent.DefaultPath()), "rekey-proxy.sock"))
+
+	// --socket: where to listen
+	rekeyProxyCmd.Flags().StringP("socket", "a", viper.GetString("rekey.proxy.Socket"), "Path of the unix socket to listen on.")
+	viper.BindPFlag("rekey.proxy.Socket", rekeyProxyCmd.Flags().Lookup("socket"))
+
+	// --cooldown: how long to wait after a failed load
+	rekeyProxyCmd.Flags().Duration("cooldown", time.Minute, "How long to wait after a key fails to load before trying again.")
+	viper.BindPFlag("rekey.proxy.Cooldown", rekeyProxyCmd.Flags().Lookup("cooldown"))
+}
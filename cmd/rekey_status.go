@@ -0,0 +1,73 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/rekey"
+)
+
+var statusJSON bool
+
+// rekeyStatusCmd represents the rekey status command
+var rekeyStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the keys loaded into ssh-agent",
+	Long: `Lists every key in ssh-agent with its fingerprint, type, and comment, the
+key types and profiles it satisfies, and whether the agent can sign with it.
+Types and profiles that no key satisfies are listed as missing.
+
+Signing a test challenge may require touching your token.`,
+	Example: `  encabulator rekey status
+  encabulator rekey status --json | jq '.missing'`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ensurers, err := allEnsurers()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		report, err := rekey.Status(ensurers, viper.GetDuration("rekey.Timeout"))
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		if statusJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(report)
+		} else {
+			err = report.Print(os.Stdout)
+		}
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyStatusCmd)
+
+	// --json: machine-readable output
+	rekeyStatusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON.")
+}
@@ -0,0 +1,67 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// rekeyUnloadCmd represents the rekey unload command
+var rekeyUnloadCmd = &cobra.Command{
+	Use:   "unload",
+	Short: "Remove your SSH keys from ssh-agent",
+	Long: `Removes the keys of the given types from the agent behind SSH_AUTH_SOCK.
+Keys loaded from PKCS#11 modules are removed with "ssh-add -e", which also
+unregisters the module; other keys, and any that "ssh-add -e" fails to remove,
+are removed one by one.
+
+Pair it with "encabulator rekey lock" in a screen lock hook, so that your
+token's keys can't be used while you're away.`,
+	Example: `  encabulator rekey unload --type=yubikey
+  encabulator rekey unload --type=yubikey,id && encabulator rekey lock`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ensurers, err := runEnsurers()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, svc := range ensurers {
+			n, err := svc.Unload()
+			switch {
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "Failed: %s: %v\n", svc, err)
+				failed = true
+			case n == 0:
+				if verbose {
+					fmt.Fprintf(os.Stderr, "Not loaded: %s\n", svc)
+				}
+			default:
+				fmt.Fprintf(os.Stderr, "Unloaded: %s\n", svc)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyUnloadCmd)
+}
@@ -0,0 +1,80 @@
+// Copyright © 2017 Jake Teton-Landis <just.1.jake@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/rekey"
+)
+
+// rekeyWatchCmd represents the rekey watch command
+var rekeyWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Keep keys loaded into ssh-agent",
+	Long: `Runs until interrupted, checking ssh-agent for the given types of keys
+every interval. Keys that expire, vanish, or stop signing are loaded again
+right away, so they're ready before your next push.
+
+If loading a key keeps failing, for example because the token is unplugged,
+watch waits longer and longer between attempts.
+
+Without a TTY, PINs are requested with SSH_ASKPASS or pinentry.`,
+	Example: `  encabulator rekey watch --type=yubikey --type=id &`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ensurers, err := runEnsurers()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		watcher := rekey.NewWatcher(ensurers...)
+		watcher.Interval = viper.GetDuration("rekey.watch.Interval")
+		watcher.MaxBackoff = viper.GetDuration("rekey.watch.MaxBackoff")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+
+		if err := watcher.Run(ctx); err != nil && err != context.Canceled {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.AddCommand(rekeyWatchCmd)
+
+	// --interval: how often to check
+	rekeyWatchCmd.Flags().Duration("interval", time.Minute, "How often to check ssh-agent.")
+	viper.BindPFlag("rekey.watch.Interval", rekeyWatchCmd.Flags().Lookup("interval"))
+
+	// --max-backoff: longest wait after failures
+	rekeyWatchCmd.Flags().Duration("max-backoff", 30*time.Minute, "Longest time to wait between attempts to load a key that keeps failing.")
+	viper.BindPFlag("rekey.watch.MaxBackoff", rekeyWatchCmd.Flags().Lookup("max-backoff"))
+}
@@ -20,6 +20,8 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/justjake/encabulator/rekey"
 )
 
 var cfgFile string
@@ -39,6 +41,11 @@ Perhaps you will find some useful?`,
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// ssh-add runs us as SSH_ASKPASS to prompt with pinentry.
+	if rekey.IsAskpass() {
+		os.Exit(rekey.RunAskpass(os.Args[1:]))
+	}
+
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -3,14 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/justjake/encabulator/task"
 	"github.com/justjake/encabulator/unison"
 	"log"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"regexp"
+	"syscall"
 	"time"
 )
 
@@ -46,19 +50,33 @@ func main() {
 		log.Fatal(err)
 	}
 
-	runForever(cmd.Build())
+	// stop unison cleanly on ^C, so it can finish writing its archives.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	runForever(ctx, cmd.Build())
 }
 
-func runForever(cmd *exec.Cmd) {
+// runForever runs cmd, respawning it when it fails, until ctx is done.
+func runForever(ctx context.Context, cmd *exec.Cmd) {
 	splitter := splitByRegexp(unisonDelim)
 	supervisor := task.MakeSupervisor(1, time.Second)
-	t, err := task.Spawn(cmd, splitter)
+	t, err := task.SpawnContext(ctx, cmd, splitter)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	for {
 		event := <-t.Output
+		if ended, ok := event.Payload.(*task.Ended); ok && ctx.Err() != nil {
+			log.Printf("Stopped unison by %v: %v", ended.By, ended.Error)
+			return
+		}
 		t, err = supervisor.HandleEvent(event)
 		if err != nil {
 			log.Fatalln(err)
@@ -19,7 +19,7 @@ func main() {
 
 	go func(t *task.Task) {
 		time.Sleep(time.Second)
-		t.Kill()
+		t.Stop(time.Second)
 	}(tee)
 
 	for event := range tee.Output {
@@ -0,0 +1,194 @@
+// Package keyagent implements an ssh-agent server backed by an in-memory
+// keyring. Unlike the system ssh-agent, a keyagent can be restarted by its
+// clients without killing any processes.
+package keyagent
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// RestartExtension is the agent extension request that asks a keyagent to
+// drop all of its keys and start over.
+const RestartExtension = "restart@encabulator"
+
+// Keyring is an agents.ExtendedAgent that holds keys in memory. It extends
+// agents.NewKeyring with support for the confirm constraint and the restart
+// extension.
+type Keyring struct {
+	// Confirm is called before signing with a key that was added with the
+	// confirm constraint. Signing is refused unless it returns true.
+	Confirm func(key ssh.PublicKey, comment string) bool
+	// DefaultLifetime applies to keys added without a lifetime. Zero keeps
+	// those keys until they are removed.
+	DefaultLifetime time.Duration
+	// OnRestart, if set, is called after the keyring restarts.
+	OnRestart func()
+
+	mu      sync.Mutex
+	keyring agents.ExtendedAgent
+	confirm map[string]bool
+}
+
+// NewKeyring returns an empty Keyring that confirms key use with
+// AskpassConfirm.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		Confirm: AskpassConfirm,
+		keyring: agents.NewKeyring().(agents.ExtendedAgent),
+		confirm: make(map[string]bool),
+	}
+}
+
+// Restart drops all keys, including locked ones.
+func (k *Keyring) Restart() {
+	k.mu.Lock()
+	k.keyring = agents.NewKeyring().(agents.ExtendedAgent)
+	k.confirm = make(map[string]bool)
+	k.mu.Unlock()
+
+	if k.OnRestart != nil {
+		k.OnRestart()
+	}
+}
+
+func (k *Keyring) current() agents.ExtendedAgent {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keyring
+}
+
+func (k *Keyring) needsConfirm(key ssh.PublicKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.confirm[ssh.FingerprintSHA256(key)]
+}
+
+// List returns the identities known to the agent.
+func (k *Keyring) List() ([]*agents.Key, error) {
+	return k.current().List()
+}
+
+// Sign has the agent sign the data using a protocol 2 key as defined in
+// [PROTOCOL.agent] section 2.6.2.
+func (k *Keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return k.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign, but allows for additional flags to be sent
+// and received.
+func (k *Keyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agents.SignatureFlags) (*ssh.Signature, error) {
+	if k.needsConfirm(key) && !k.confirmed(key) {
+		return nil, errors.New("agent: signing not confirmed")
+	}
+	return k.current().SignWithFlags(key, data, flags)
+}
+
+func (k *Keyring) confirmed(key ssh.PublicKey) bool {
+	if k.Confirm == nil {
+		return false
+	}
+	comment := ""
+	if keys, err := k.List(); err == nil {
+		for _, listed := range keys {
+			if string(listed.Blob) == string(key.Marshal()) {
+				comment = listed.Comment
+			}
+		}
+	}
+	return k.Confirm(key, comment)
+}
+
+// Add adds a private key to the agent, honoring its lifetime and confirm
+// constraints.
+func (k *Keyring) Add(key agents.AddedKey) error {
+	if key.LifetimeSecs == 0 && k.DefaultLifetime > 0 {
+		key.LifetimeSecs = uint32(k.DefaultLifetime / time.Second)
+	}
+	confirm := key.ConfirmBeforeUse
+	key.ConfirmBeforeUse = false
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	pub := signer.PublicKey()
+	if key.Certificate != nil {
+		pub = key.Certificate
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.keyring.Add(key); err != nil {
+		return err
+	}
+	k.confirm[ssh.FingerprintSHA256(pub)] = confirm
+	return nil
+}
+
+// Remove removes all identities with the given public key.
+func (k *Keyring) Remove(key ssh.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.confirm, ssh.FingerprintSHA256(key))
+	return k.keyring.Remove(key)
+}
+
+// RemoveAll removes all identities.
+func (k *Keyring) RemoveAll() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.confirm = make(map[string]bool)
+	return k.keyring.RemoveAll()
+}
+
+// Lock locks the agent. Sign and Remove will fail, and List will return an
+// empty list.
+func (k *Keyring) Lock(passphrase []byte) error {
+	return k.current().Lock(passphrase)
+}
+
+// Unlock undoes the effect of Lock.
+func (k *Keyring) Unlock(passphrase []byte) error {
+	return k.current().Unlock(passphrase)
+}
+
+// Signers returns signers for all the known keys.
+func (k *Keyring) Signers() ([]ssh.Signer, error) {
+	return k.current().Signers()
+}
+
+// Extension handles the restart extension. Other extensions are unsupported.
+func (k *Keyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != RestartExtension {
+		return nil, agents.ErrExtensionUnsupported
+	}
+	k.Restart()
+	return nil, nil
+}
+
+// Restart asks the keyagent behind the given agent to restart. Returns
+// agents.ErrExtensionUnsupported if the agent is not a keyagent.
+func Restart(agent agents.ExtendedAgent) error {
+	_, err := agent.Extension(RestartExtension, nil)
+	return err
+}
+
+// AskpassConfirm asks the user to confirm use of a key using the program in
+// SSH_ASKPASS, the same way ssh-agent does. Returns false if SSH_ASKPASS is
+// unset.
+func AskpassConfirm(key ssh.PublicKey, comment string) bool {
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		return false
+	}
+	prompt := "Allow use of key " + comment + "?\nKey fingerprint " + ssh.FingerprintSHA256(key) + "."
+	cmd := exec.Command(askpass, prompt)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+	return cmd.Run() == nil
+}
@@ -0,0 +1,24 @@
+package keyagent
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"testing"
+	"time"
+)
+
+func TestKeyring_Lifetime(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.DefaultLifetime = time.Second
+	forever := rekeytest.GenerateKey("forever")
+	forever.LifetimeSecs = 3600
+	assert.Equal(t, keyring.Add(forever), nil)
+	assert.Equal(t, keyring.Add(rekeytest.GenerateKey("default")), nil)
+	keys, _ := keyring.List()
+	assert.Equal(t, len(keys), 2)
+
+	time.Sleep(1100 * time.Millisecond)
+	keys, _ = keyring.List()
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Comment, "forever")
+}
@@ -0,0 +1,44 @@
+package keyagent
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"syscall"
+)
+
+// from <sys/un.h>
+const (
+	solLocal     = 0
+	localPeerPID = 0x002
+)
+
+// PeerPID returns the pid of the process on the other end of a unix socket,
+// using LOCAL_PEERPID.
+func PeerPID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var pid int
+	var pidErr error
+	err = raw.Control(func(fd uintptr) {
+		pid, pidErr = syscall.GetsockoptInt(int(fd), solLocal, localPeerPID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pid, pidErr
+}
+
+// OwnerPID returns the pid of the process serving the unix socket at path,
+// which conn is connected to.
+func OwnerPID(conn *net.UnixConn, path string) (int, error) {
+	return PeerPID(conn)
+}
+
+// ListenerPID is not supported on macOS. PeerPID is accurate there, because
+// LOCAL_PEERPID reports the current owner of the socket.
+func ListenerPID(path string) (int, error) {
+	return 0, errors.New("Finding the owner of a unix socket is not supported on darwin")
+}
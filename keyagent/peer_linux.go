@@ -0,0 +1,88 @@
+package keyagent
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PeerPID returns the pid of the process on the other end of a unix socket,
+// using SO_PEERCRED.
+func PeerPID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Pid), nil
+}
+
+// OwnerPID returns the pid of the process serving the unix socket at path,
+// which conn is connected to. The peer credentials of conn name the process
+// that called listen(), which may have exited since, as ssh-agent's parent
+// does when it daemonizes. In that case the socket's listener is looked up
+// instead.
+func OwnerPID(conn *net.UnixConn, path string) (int, error) {
+	pid, err := PeerPID(conn)
+	if err == nil && pid > 0 {
+		if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+			return pid, nil
+		}
+	}
+	return ListenerPID(path)
+}
+
+// ListenerPID returns the pid of a process that holds the listening unix
+// socket at path, by matching the socket's inode in /proc/net/unix against
+// the open files of each process.
+func ListenerPID(path string) (int, error) {
+	inode, err := socketInode(path)
+	if err != nil {
+		return 0, err
+	}
+	target := fmt.Sprintf("socket:[%s]", inode)
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return 0, err
+	}
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && link == target {
+			// fd looks like /proc/<pid>/fd/<n>
+			return strconv.Atoi(strings.Split(fd, "/")[2])
+		}
+	}
+	return 0, errors.Errorf("No process found listening on %s", path)
+}
+
+func socketInode(path string) (string, error) {
+	data, err := ioutil.ReadFile("/proc/net/unix")
+	if err != nil {
+		return "", err
+	}
+	// Num RefCount Protocol Flags Type St Inode Path
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 8 && fields[7] == path {
+			return fields[6], nil
+		}
+	}
+	return "", errors.Errorf("No unix socket %s in /proc/net/unix", path)
+}
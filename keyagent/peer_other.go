@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package keyagent
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"runtime"
+)
+
+// PeerPID is not supported on this platform.
+func PeerPID(conn *net.UnixConn) (int, error) {
+	return 0, errors.Errorf("Finding the peer of a unix socket is not supported on %s", runtime.GOOS)
+}
+
+// OwnerPID is not supported on this platform.
+func OwnerPID(conn *net.UnixConn, path string) (int, error) {
+	return PeerPID(conn)
+}
+
+// ListenerPID is not supported on this platform.
+func ListenerPID(path string) (int, error) {
+	return 0, errors.Errorf("Finding the owner of a unix socket is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,101 @@
+package keyagent
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Server serves an agent on a unix socket.
+type Server struct {
+	// Path of the unix socket.
+	Path  string
+	Agent agents.Agent
+	// AgentFor, if set, returns the agent to serve on each connection instead
+	// of Agent, eg to tell clients apart with PeerPID.
+	AgentFor func(conn *net.UnixConn) agents.Agent
+
+	listener net.Listener
+}
+
+// Listen creates a unix socket at path that only the current user can use,
+// replacing any stale socket, and returns a Server ready to serve the agent.
+func Listen(path string, agent agents.Agent) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("An agent is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "Removing stale socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Server{Path: path, Agent: agent, listener: listener}, nil
+}
+
+// Serve accepts connections until the server is closed, serving each
+// connection in its own goroutine.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			agents.ServeAgent(s.agentFor(conn), conn)
+		}(conn)
+	}
+}
+
+func (s *Server) agentFor(conn net.Conn) agents.Agent {
+	if unix, ok := conn.(*net.UnixConn); ok && s.AgentFor != nil {
+		return s.AgentFor(unix)
+	}
+	return s.Agent
+}
+
+// Close stops the server and removes its socket.
+func (s *Server) Close() error {
+	// closing a unix listener also removes the socket file.
+	return s.listener.Close()
+}
+
+// Exports returns shell commands that point SSH clients at the agent on the
+// given socket, in the same format as `ssh-agent -s`. A pid of 0 is omitted.
+func Exports(sock string, pid int) string {
+	out := fmt.Sprintf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", shellQuote(sock))
+	if pid > 0 {
+		out += fmt.Sprintf("SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", pid)
+	}
+	return out
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// DefaultPath returns the default location of the keyagent socket,
+// ~/.encabulator/agent.sock.
+func DefaultPath() string {
+	u, _ := user.Current()
+	return filepath.Join(u.HomeDir, ".encabulator", "agent.sock")
+}
@@ -0,0 +1,106 @@
+package keyagent
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serve serves keyring on a new socket, and returns a client connected to it.
+func serve(t *testing.T, keyring *Keyring) (agents.ExtendedAgent, func()) {
+	dir, err := ioutil.TempDir("", "keyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := Listen(filepath.Join(dir, "agent.sock"), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	info, err := os.Stat(server.Path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Mode()&os.ModePerm, os.FileMode(0600))
+
+	conn, err := net.Dial("unix", server.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agents.NewClient(conn), func() {
+		conn.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServer_RoundTrip(t *testing.T) {
+	keyring := NewKeyring()
+	keyring.Confirm = func(key ssh.PublicKey, comment string) bool { return comment == "yes" }
+	client, done := serve(t, keyring)
+	defer done()
+
+	key := rekeytest.GenerateKey("work@example")
+	public := rekeytest.PublicKey(key)
+	assert.Equal(t, client.Add(key), nil)
+	keys, err := client.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Comment, "work@example")
+
+	sig, err := client.Sign(public, []byte("data"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, public.Verify([]byte("data"), sig), nil)
+
+	// keys added with the confirm constraint sign only when confirmed.
+	refused := rekeytest.GenerateKey("no")
+	refused.ConfirmBeforeUse = true
+	assert.Equal(t, client.Add(refused), nil)
+	_, err = client.Sign(rekeytest.PublicKey(refused), []byte("data"))
+	assert.Equal(t, err != nil, true)
+	confirmed := rekeytest.GenerateKey("yes")
+	confirmed.ConfirmBeforeUse = true
+	assert.Equal(t, client.Add(confirmed), nil)
+	_, err = client.Sign(rekeytest.PublicKey(confirmed), []byte("data"))
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, client.Remove(public), nil)
+	keys, _ = client.List()
+	assert.Equal(t, len(keys), 2)
+	_, err = client.Sign(public, []byte("data"))
+	assert.Equal(t, err != nil, true)
+
+	// clients restart the keyring instead of killing it.
+	assert.Equal(t, Restart(client), nil)
+	keys, _ = client.List()
+	assert.Equal(t, len(keys), 0)
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	server, err := Listen(path, NewKeyring())
+	assert.Equal(t, err, nil)
+	_, err = Listen(path, NewKeyring())
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, server.Close(), nil)
+
+	// a socket nobody listens on is replaced.
+	stale, err := net.Listen("unix", path)
+	assert.Equal(t, err, nil)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	server, err = Listen(path, NewKeyring())
+	assert.Equal(t, err, nil)
+	server.Close()
+}
@@ -0,0 +1,106 @@
+package rekey
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// AssuanError is an ERR response from an Assuan server, such as pinentry or
+// gpg-agent.
+type AssuanError struct {
+	Code    int
+	Message string
+}
+
+func (e *AssuanError) Error() string {
+	return fmt.Sprintf("ERR %d %s", e.Code, e.Message)
+}
+
+// Cancelled returns true if the user cancelled the operation.
+func (e *AssuanError) Cancelled() bool {
+	// GPG_ERR_CANCELED, in the pinentry and gpg-agent error sources.
+	return e.Code&0xffff == 99
+}
+
+// assuanConn speaks the client side of the Assuan protocol, as used by
+// pinentry and gpg-agent.
+type assuanConn struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func newAssuanConn(r io.Reader, w io.Writer) *assuanConn {
+	return &assuanConn{bufio.NewReader(r), w}
+}
+
+// Transact sends a command and returns the data lines of the response.
+func (c *assuanConn) Transact(command string) ([]byte, error) {
+	if _, err := fmt.Fprintf(c.w, "%s\n", command); err != nil {
+		return nil, err
+	}
+	return c.ReadResponse()
+}
+
+// ReadResponse reads lines until an OK or ERR line, returning the decoded
+// contents of any D lines along the way. Status and comment lines are
+// ignored.
+func (c *assuanConn) ReadResponse() ([]byte, error) {
+	var data bytes.Buffer
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading Assuan response")
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.Bytes(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, parseAssuanError(line[len("ERR "):])
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(assuanUnescape(line[len("D "):]))
+		case strings.HasPrefix(line, "INQUIRE "):
+			// we never have anything to offer.
+			if _, err := fmt.Fprintf(c.w, "CAN\n"); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func parseAssuanError(rest string) error {
+	parts := strings.SplitN(rest, " ", 2)
+	code, _ := strconv.Atoi(parts[0])
+	message := ""
+	if len(parts) > 1 {
+		message = parts[1]
+	}
+	return &AssuanError{code, message}
+}
+
+// assuanEscape percent-encodes the characters that may not appear literally in
+// an Assuan line.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(s)
+}
+
+func assuanUnescape(s string) string {
+	var out bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
@@ -0,0 +1,221 @@
+package rekey
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"net"
+	"time"
+)
+
+// certClockSkew backdates certificates issued by CertSigner, so that hosts
+// with slow clocks accept them right away.
+const certClockSkew = time.Minute
+
+// CertRule requires a profile's key to be loaded with an OpenSSH user
+// certificate that is valid now, and for the given principals. In the config
+// file:
+//
+//	certificate:
+//	  principals: [deploy]
+//	  minValidity: 10m
+//	  ca: ~/.ssh/ca        # sign locally; otherwise the profile's load rule
+//	  key: ~/.ssh/id_work  # must issue and load the certificate
+//	  validity: 8h
+type CertRule struct {
+	// Principals must all be listed in the certificate. A certificate
+	// without principals is valid for any.
+	Principals []string
+	// MinValidity treats certificates that expire within this duration as
+	// expired.
+	MinValidity time.Duration
+	// CA is the path to a CA private key. If set, rekey issues certificates
+	// for Key itself; see CertSigner.
+	CA string
+	// Key is the path to the private key to certify with CA.
+	Key string
+	// Validity is how long certificates issued with CA are valid. Zero means
+	// DefaultLifetime.
+	Validity time.Duration
+}
+
+// Enabled returns true if the rule is set.
+func (c CertRule) Enabled() bool {
+	return len(c.Principals) > 0 || c.MinValidity > 0 || c.CA != ""
+}
+
+// Certificate returns key's certificate, or nil if it isn't one.
+func Certificate(key *agents.Key) *ssh.Certificate {
+	parsed, err := ssh.ParsePublicKey(key.Blob)
+	if err != nil {
+		return nil
+	}
+	cert, _ := parsed.(*ssh.Certificate)
+	return cert
+}
+
+// ByCertificate returns a Predicate that matches certificates in the agent
+// that satisfy rule at the time given by now, and whose certified key matches
+// keyPredicate.
+func ByCertificate(rule CertRule, keyPredicate Predicate, now func() time.Time) Predicate {
+	return func(key *agents.Key) bool {
+		cert := Certificate(key)
+		if cert == nil || cert.CertType != ssh.UserCert {
+			return false
+		}
+		if !certValid(cert, now()) || !certValid(cert, now().Add(rule.MinValidity)) {
+			return false
+		}
+		if !hasPrincipals(cert, rule.Principals) {
+			return false
+		}
+		certified := &agents.Key{
+			Format:  cert.Key.Type(),
+			Blob:    cert.Key.Marshal(),
+			Comment: key.Comment,
+		}
+		return keyPredicate(certified)
+	}
+}
+
+// certValid returns true if cert is valid at t.
+func certValid(cert *ssh.Certificate, t time.Time) bool {
+	unix := uint64(t.Unix())
+	if unix < cert.ValidAfter {
+		return false
+	}
+	return cert.ValidBefore == ssh.CertTimeInfinity || unix < cert.ValidBefore
+}
+
+func hasPrincipals(cert *ssh.Certificate, principals []string) bool {
+	if len(cert.ValidPrincipals) == 0 {
+		return true
+	}
+	valid := make(map[string]bool)
+	for _, principal := range cert.ValidPrincipals {
+		valid[principal] = true
+	}
+	for _, principal := range principals {
+		if !valid[principal] {
+			return false
+		}
+	}
+	return true
+}
+
+// CertSigner issues a certificate for a key with a local CA key, and loads the
+// key and certificate into the agent together.
+type CertSigner struct {
+	// Key and CA are paths to private keys. Encrypted keys are decrypted with
+	// a passphrase from Prompter, or NewPrompter if nil.
+	Key      string
+	CA       string
+	Prompter Prompter
+	// KeyID is recorded in the certificate, and shows up in sshd's logs.
+	KeyID      string
+	Principals []string
+	// Validity is how long the certificate is valid. Zero means
+	// DefaultLifetime.
+	Validity time.Duration
+	// Lifetime is how long the agent keeps the key. It is capped at
+	// Validity.
+	Lifetime time.Duration
+	// Dial connects to ssh-agent. Nil dials SSH_AUTH_SOCK.
+	Dial func() (net.Conn, error)
+	// Now tells the time the certificate is issued. Nil uses time.Now.
+	Now func() time.Time
+}
+
+// Load issues a certificate, and adds it to the agent behind SSH_AUTH_SOCK.
+func (c *CertSigner) Load() error {
+	dial := c.Dial
+	if dial == nil {
+		dial = dialAgent
+	}
+	conn, err := dial()
+	if err != nil {
+		return &AgentUnreachableError{err}
+	}
+	defer conn.Close()
+	return c.LoadInto(agents.NewClient(conn))
+}
+
+// LoadInto issues a certificate, and adds it to the given agent.
+func (c *CertSigner) LoadInto(agent agents.Agent) error {
+	key, err := readPrivateKey(ExpandHome(c.Key), c.Prompter)
+	if err != nil {
+		return errors.Wrapf(err, "Reading %s", c.Key)
+	}
+	cert, err := c.Issue(key)
+	if err != nil {
+		return err
+	}
+
+	lifetime := c.Lifetime
+	if lifetime <= 0 || lifetime > c.validity() {
+		lifetime = c.validity()
+	}
+	return agent.Add(agents.AddedKey{
+		PrivateKey:   key,
+		Certificate:  cert,
+		Comment:      keyComment(ExpandHome(c.Key)),
+		LifetimeSecs: uint32(lifetime / time.Second),
+	})
+}
+
+// Issue signs a new user certificate for the given private key.
+func (c *CertSigner) Issue(key interface{}) (*ssh.Certificate, error) {
+	ca, err := readPrivateKey(ExpandHome(c.CA), c.Prompter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading CA %s", c.CA)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		return nil, errors.Wrap(err, "CA key")
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if c.Now != nil {
+		now = c.Now()
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           c.KeyID,
+		ValidPrincipals: c.Principals,
+		ValidAfter:      uint64(now.Add(-certClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(c.validity()).Unix()),
+		Permissions: ssh.Permissions{
+			// the same extensions as ssh-keygen grants by default.
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, errors.Wrap(err, "Signing certificate")
+	}
+	return cert, nil
+}
+
+func (c *CertSigner) validity() time.Duration {
+	if c.Validity <= 0 {
+		return DefaultLifetime
+	}
+	return c.Validity
+}
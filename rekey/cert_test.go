@@ -0,0 +1,131 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfile_Certificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, filepath.Join(dir, "ca"), "ca@example", "")
+	writeKey(t, filepath.Join(dir, "id_work"), "work@example", "")
+
+	profile := &Profile{
+		Name:  "work",
+		Match: MatchRule{AuthorizedKeys: filepath.Join(dir, "id_work.pub")},
+		Certificate: CertRule{
+			Principals:  []string{"deploy"},
+			MinValidity: 10 * time.Minute,
+			CA:          filepath.Join(dir, "ca"),
+			Key:         filepath.Join(dir, "id_work"),
+			Validity:    time.Hour,
+		},
+	}
+	svc, err := profile.Ensurer()
+	assert.Equal(t, err, nil)
+
+	agent := rekeytest.NewAgent()
+	clock := rekeytest.NewClock(time.Now())
+	svc.Dial = agent.Dial
+	svc.Now = clock.Now
+	svc.ProbeTimeout = time.Second
+
+	// the bare key doesn't count.
+	private, err := readPrivateKey(filepath.Join(dir, "id_work"), nil)
+	assert.Equal(t, err, nil)
+	agent.Add(agents.AddedKey{PrivateKey: private, Comment: "work@example"})
+	keys, _ := agent.List()
+	matchesKey, err := profile.Match.Predicate()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, matchesKey(keys[0]), true)
+	assert.Equal(t, svc.KeyPredicate(keys[0]), false)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+
+	keys, _ = agent.List()
+	assert.Equal(t, len(keys), 2)
+	cert := Certificate(keys[1])
+	assert.Equal(t, cert.KeyId, "work")
+	assert.Equal(t, cert.ValidPrincipals, []string{"deploy"})
+	assert.Equal(t, svc.KeyPredicate(keys[1]), true)
+
+	// about to expire.
+	clock.Advance(55 * time.Minute)
+	assert.Equal(t, svc.KeyPredicate(keys[1]), false)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	keys, _ = agent.List()
+	assert.Equal(t, len(keys), 3)
+
+	// missing a principal.
+	rule := profile.Certificate
+	rule.Principals = []string{"deploy", "root"}
+	assert.Equal(t, ByCertificate(rule, Any, clock.Now)(keys[2]), false)
+}
+
+func TestProfile_CertificateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKey(t, filepath.Join(dir, "ca"), "ca@example", "")
+	writeKey(t, filepath.Join(dir, "id_work"), "work@example", "")
+
+	profile := &Profile{
+		Name:  "work",
+		Match: MatchRule{AuthorizedKeys: filepath.Join(dir, "id_work.pub")},
+		Certificate: CertRule{
+			Principals:  []string{"deploy"},
+			MinValidity: 10 * time.Minute,
+		},
+		Load: LoadRule{Command: []string{"issue-cert", "--principal", "deploy"}},
+	}
+	svc, err := profile.Ensurer()
+	assert.Equal(t, err, nil)
+
+	agent := rekeytest.NewAgent()
+	clock := rekeytest.NewClock(time.Now())
+	// the command stands in for an external CA client, like `step ssh login`.
+	issuer := &CertSigner{
+		Key:        filepath.Join(dir, "id_work"),
+		CA:         filepath.Join(dir, "ca"),
+		Principals: []string{"deploy"},
+		Validity:   time.Hour,
+		Now:        clock.Now,
+	}
+	runner := &rekeytest.Runner{Func: func(cmd *exec.Cmd) error {
+		return issuer.LoadInto(agent)
+	}}
+	svc.Dial = agent.Dial
+	svc.Now = clock.Now
+	svc.Run = runner.Run
+	svc.ProbeTimeout = time.Second
+
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, runner.Commands, [][]string{{"issue-cert", "--principal", "deploy"}})
+	keys, _ := agent.List()
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, svc.KeyPredicate(keys[0]), true)
+
+	// still valid.
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, len(runner.Commands), 1)
+
+	// about to expire, so the command issues another.
+	clock.Advance(55 * time.Minute)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, len(runner.Commands), 2)
+	keys, _ = agent.List()
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, svc.KeyPredicate(keys[1]), true)
+}
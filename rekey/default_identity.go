@@ -1,29 +1,104 @@
 package rekey
 
 import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"strings"
 )
 
-// LoadDefaultIdentity runs `ssh-add` to load the user's default identity into
-// ssh-agent.
+// LoadDefaultIdentity loads the user's default identities, DefaultKeyFiles,
+// into ssh-agent until it exits, like `ssh-add` does. Keys are loaded with a
+// KeyFileLoader, except for security keys (id_*_sk), which need `ssh-add`.
 func LoadDefaultIdentity() error {
-	cmd := exec.Command("ssh-add")
+	return loadDefaultIdentity(&KeyEnsurer{Lifetime: Forever})
+}
+
+// loadDefaultIdentity loads the default identities, dialing the agent and
+// running ssh-add with svc.
+func loadDefaultIdentity(svc *KeyEnsurer) error {
+	paths, securityKeys, err := defaultIdentityFiles(DefaultKeyFiles)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 && len(securityKeys) == 0 {
+		return errors.Errorf("No private keys found in %s", strings.Join(DefaultKeyFiles, ", "))
+	}
+
+	var firstErr error
+	if len(paths) > 0 {
+		firstErr = (&KeyFileLoader{Paths: paths, Lifetime: svc.Lifetime, Dial: svc.dial}).Load()
+	}
+	for _, path := range securityKeys {
+		if err := fileLoader(path, svc.Lifetime, svc.run)(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Loading %s", path)
+		}
+	}
+	return firstErr
+}
+
+// defaultIdentityFiles returns which of the given identity files exist, with
+// the security keys among them separately.
+func defaultIdentityFiles(files []string) ([]string, []string, error) {
+	paths, err := globKeyFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	securityKeys := []string{}
+	for _, file := range files {
+		path := ExpandHome(file)
+		if _, err := os.Stat(path); strings.HasSuffix(path, "_sk") && err == nil {
+			securityKeys = append(securityKeys, path)
+		}
+	}
+	return paths, securityKeys, nil
+}
+
+// ByDefaultIdentity matches the keys of the default identities, and
+// certificates for them. The keys are read once, from the .pub file next to
+// each private key, or from the private key itself if it isn't encrypted.
+func ByDefaultIdentity() Predicate {
+	paths, securityKeys, _ := defaultIdentityFiles(DefaultKeyFiles)
+	return byKeyFiles(append(paths, securityKeys...))
+}
 
-	// pass along IO so users can type into the loader
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// byKeyFiles matches the keys of the given private key files, and certificates
+// for them.
+func byKeyFiles(paths []string) Predicate {
+	fingerprints := []string{}
+	for _, path := range paths {
+		if found, err := ReadFingerprints(path + ".pub"); err == nil {
+			fingerprints = append(fingerprints, found...)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			fingerprints = append(fingerprints, Fingerprint(signer.PublicKey()))
+		}
+	}
 
-	return cmd.Run()
+	byKey := ByFingerprint(fingerprints...)
+	return func(key *agents.Key) bool {
+		if cert := Certificate(key); cert != nil {
+			return byKey(&agents.Key{Format: cert.Key.Type(), Blob: cert.Key.Marshal()})
+		}
+		return byKey(key)
+	}
 }
 
-// DefaultIdentity returns a KeyEnsurer that ensures that "some" identity is
-// loaded. If none is present, the default identity is loaded via `ssh-add`
+// DefaultIdentity returns a KeyEnsurer that ensures that one of the default
+// identities is loaded. If none is present, they are loaded like
+// LoadDefaultIdentity does. Unless a Lifetime is set, they are kept until
+// the agent exits. Other keys in the agent, like those on a token, don't
+// count, so filtering or unloading "id" leaves them alone.
 func DefaultIdentity() *KeyEnsurer {
-	return New(
-		func(_ *agents.Key) bool { return true },
-		LoadDefaultIdentity,
-	)
+	svc := New(ByDefaultIdentity(), nil).Named("id")
+	svc.Lifetime = Forever
+	svc.KeyLoader = func() error { return loadDefaultIdentity(svc) }
+	return svc
 }
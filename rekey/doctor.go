@@ -0,0 +1,164 @@
+package rekey
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+// Check is the result of one of Doctor's checks.
+type Check struct {
+	Name string
+	// Detail describes what was found, such as the path of a module.
+	Detail string
+	// Err is set if the check failed.
+	Err error
+	// Optional checks, like modules for tokens you may not use, don't make
+	// the diagnosis fail.
+	Optional bool
+}
+
+// Diagnosis is the result of Doctor.
+type Diagnosis []*Check
+
+// Doctor checks that rekey can work: that ssh-add is installed, that the
+// agent behind SSH_AUTH_SOCK answers, whether gpg-agent's OpenPGP card support
+// is available, that PINs can be prompted for, and which PKCS#11 modules can
+// be found. Missing modules named in required fail the diagnosis;
+// KnownModules are reported but optional.
+func Doctor(required []string) Diagnosis {
+	return newDoctor().diagnose(required)
+}
+
+// doctor runs Doctor's checks against the system, or against fakes in tests.
+type doctor struct {
+	lookPath     func(file string) (string, error)
+	dial         func() (net.Conn, error)
+	hasTTY       func() bool
+	findPrompter func() (Prompter, error)
+	findModule   func(name string) (string, error)
+}
+
+func newDoctor() *doctor {
+	return &doctor{
+		lookPath:     exec.LookPath,
+		dial:         dialAgent,
+		hasTTY:       hasTTY,
+		findPrompter: FindPrompter,
+		findModule:   FindModule,
+	}
+}
+
+func (d *doctor) diagnose(required []string) Diagnosis {
+	diagnosis := Diagnosis{}
+
+	check := &Check{Name: "ssh-add"}
+	check.Detail, check.Err = d.lookPath("ssh-add")
+	diagnosis = append(diagnosis, check)
+
+	diagnosis = append(diagnosis, d.checkAgent())
+
+	check = &Check{Name: "gpg-connect-agent", Optional: true}
+	check.Detail, check.Err = d.lookPath(GPGConnectAgentProgram)
+	diagnosis = append(diagnosis, check)
+
+	check = &Check{Name: "PIN prompt", Optional: true}
+	if d.hasTTY() {
+		check.Detail = "terminal"
+	} else if prompter, err := d.findPrompter(); err != nil {
+		check.Err = err
+	} else {
+		check.Detail = describePrompter(prompter)
+	}
+	diagnosis = append(diagnosis, check)
+
+	seen := make(map[string]bool)
+	for _, name := range required {
+		if !seen[name] {
+			seen[name] = true
+			diagnosis = append(diagnosis, d.checkModule(name, false))
+		}
+	}
+	for _, name := range KnownModules {
+		if !seen[name] {
+			seen[name] = true
+			diagnosis = append(diagnosis, d.checkModule(name, true))
+		}
+	}
+	return diagnosis
+}
+
+func (d *doctor) checkAgent() *Check {
+	check := &Check{Name: SSHAuthSock, Detail: os.Getenv(SSHAuthSock)}
+	conn, err := d.dial()
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	defer conn.Close()
+
+	keys, err := agents.NewClient(conn).List()
+	if err != nil {
+		check.Err = errors.Wrap(err, "Listing keys")
+		return check
+	}
+	check.Detail = fmt.Sprintf("%s (%d keys)", check.Detail, len(keys))
+	return check
+}
+
+func describePrompter(prompter Prompter) string {
+	switch p := prompter.(type) {
+	case *Pinentry:
+		return "pinentry " + p.Program
+	case *Askpass:
+		return SSHAskpass + " " + p.Program
+	}
+	return fmt.Sprintf("%T", prompter)
+}
+
+func (d *doctor) checkModule(name string, optional bool) *Check {
+	check := &Check{Name: "module " + name, Optional: optional}
+	check.Detail, check.Err = d.findModule(name)
+	return check
+}
+
+// OK returns true if every check that isn't optional passed.
+func (d Diagnosis) OK() bool {
+	for _, check := range d {
+		if check.Err != nil && !check.Optional {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes a human-readable table of the diagnosis to w.
+func (d Diagnosis) Print(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	notFound := false
+	for _, check := range d {
+		result := "ok"
+		detail := check.Detail
+		if check.Err != nil {
+			result, detail = "FAIL", check.Err.Error()
+			if check.Optional {
+				result = "missing"
+			}
+			if _, ok := check.Err.(*ModuleNotFoundError); ok {
+				detail = "not found"
+				notFound = true
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", check.Name, result, detail)
+	}
+	if notFound {
+		fmt.Fprintf(table, "Searched for modules in %s\n", strings.Join(ModuleSearchPath, ":"))
+	}
+	return table.Flush()
+}
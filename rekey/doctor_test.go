@@ -0,0 +1,96 @@
+package rekey
+
+import (
+	"bytes"
+	"errors"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"net"
+	"testing"
+)
+
+// fakeDoctor returns a doctor that finds the given programs and modules, and
+// dials agent.
+func fakeDoctor(agent *rekeytest.Agent, found map[string]string) *doctor {
+	find := func(name string) (string, error) {
+		if path, ok := found[name]; ok {
+			return path, nil
+		}
+		return "", errors.New("executable file not found in $PATH")
+	}
+	return &doctor{
+		lookPath:     find,
+		dial:         agent.Dial,
+		hasTTY:       func() bool { return false },
+		findPrompter: func() (Prompter, error) { return &Pinentry{"/usr/bin/pinentry"}, nil },
+		findModule: func(name string) (string, error) {
+			if path, ok := found[name]; ok {
+				return path, nil
+			}
+			return "", &ModuleNotFoundError{name, ModuleSearchPath}
+		},
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	defer setenv(SSHAuthSock, "/tmp/agent.sock")()
+	defer func(path []string) { ModuleSearchPath = path }(ModuleSearchPath)
+	ModuleSearchPath = []string{"/usr/lib"}
+
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("fake"))
+	d := fakeDoctor(agent, map[string]string{
+		"ssh-add":           "/usr/bin/ssh-add",
+		"gpg-connect-agent": "/usr/bin/gpg-connect-agent",
+		"libykcs11":         "/usr/lib/libykcs11.so",
+		"opensc-pkcs11":     "/usr/lib/opensc-pkcs11.so",
+		"p11-kit-proxy":     "/usr/lib/p11-kit-proxy.so",
+	})
+	diagnosis := d.diagnose([]string{"libykcs11"})
+	assert.Equal(t, diagnosis.OK(), true)
+	out := &bytes.Buffer{}
+	assert.Equal(t, diagnosis.Print(out), nil)
+	assert.Equal(t, out.String(), `ssh-add               ok  /usr/bin/ssh-add
+SSH_AUTH_SOCK         ok  /tmp/agent.sock (1 keys)
+gpg-connect-agent     ok  /usr/bin/gpg-connect-agent
+PIN prompt            ok  pinentry /usr/bin/pinentry
+module libykcs11      ok  /usr/lib/libykcs11.so
+module opensc-pkcs11  ok  /usr/lib/opensc-pkcs11.so
+module p11-kit-proxy  ok  /usr/lib/p11-kit-proxy.so
+`)
+
+	// optional checks may fail.
+	d = fakeDoctor(agent, map[string]string{"ssh-add": "/usr/bin/ssh-add"})
+	d.findPrompter = func() (Prompter, error) { return nil, errors.New("no pinentry") }
+	diagnosis = d.diagnose(nil)
+	assert.Equal(t, diagnosis.OK(), true)
+	out.Reset()
+	assert.Equal(t, diagnosis.Print(out), nil)
+	assert.Equal(t, out.String(), `ssh-add               ok       /usr/bin/ssh-add
+SSH_AUTH_SOCK         ok       /tmp/agent.sock (1 keys)
+gpg-connect-agent     missing  executable file not found in $PATH
+PIN prompt            missing  no pinentry
+module libykcs11      missing  not found
+module opensc-pkcs11  missing  not found
+module p11-kit-proxy  missing  not found
+Searched for modules in /usr/lib
+`)
+
+	// required modules, ssh-add, and the agent may not.
+	d = fakeDoctor(agent, map[string]string{})
+	d.hasTTY = func() bool { return true }
+	d.dial = func() (net.Conn, error) { return nil, errors.New("connection refused") }
+	diagnosis = d.diagnose([]string{"libykcs11"})
+	assert.Equal(t, diagnosis.OK(), false)
+	out.Reset()
+	assert.Equal(t, diagnosis.Print(out), nil)
+	assert.Equal(t, out.String(), `ssh-add               FAIL     executable file not found in $PATH
+SSH_AUTH_SOCK         FAIL     connection refused
+gpg-connect-agent     missing  executable file not found in $PATH
+PIN prompt            ok       terminal
+module libykcs11      FAIL     not found
+module opensc-pkcs11  missing  not found
+module p11-kit-proxy  missing  not found
+Searched for modules in /usr/lib
+`)
+}
@@ -0,0 +1,94 @@
+package rekey
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"os/exec"
+	"time"
+)
+
+// SecurityKeyTypes are the key types of FIDO security keys, as made by
+// `ssh-keygen -t ed25519-sk` and `ssh-keygen -t ecdsa-sk`, and of their
+// certificates.
+var SecurityKeyTypes = []string{
+	ssh.KeyAlgoSKED25519,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.CertAlgoSKED25519v01,
+	ssh.CertAlgoSKECDSA256v01,
+}
+
+// IsSecurityKey returns true if the given key is on a FIDO security key, like
+// a recent Yubikey used without PIV.
+func IsSecurityKey(key *agents.Key) bool {
+	return isSecurityKeyType(key.Format)
+}
+
+func isSecurityKeyType(keyType string) bool {
+	for _, skType := range SecurityKeyTypes {
+		if keyType == skType {
+			return true
+		}
+	}
+	return false
+}
+
+// PresenceRequiredError means that a security key is loaded, but didn't sign,
+// usually because nobody touched it in time. Loading the key again won't
+// help.
+type PresenceRequiredError struct {
+	Key *agents.Key
+	Err error
+}
+
+func (e *PresenceRequiredError) Error() string {
+	return fmt.Sprintf("Security key %s was not touched: %v", Fingerprint(e.Key), e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *PresenceRequiredError) Cause() error {
+	return e.Err
+}
+
+// IsPresenceRequired returns true if err was caused by a
+// PresenceRequiredError.
+func IsPresenceRequired(err error) bool {
+	for err != nil {
+		if _, ok := err.(*PresenceRequiredError); ok {
+			return true
+		}
+		causer, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+// ResidentLoader returns a function that loads the resident keys of the
+// plugged-in FIDO security keys using `ssh-add -K`, which asks for the
+// token's PIN.
+func ResidentLoader(lifetime time.Duration) func() error {
+	return residentLoader(lifetime, runInteractive)
+}
+
+func residentLoader(lifetime time.Duration, run func(*exec.Cmd) error) func() error {
+	return func() error {
+		return run(sshAdd(append([]string{"-K"}, lifetimeArgs(lifetime)...)...))
+	}
+}
+
+// SecurityKey returns a KeyEnsurer that ensures that a key from a FIDO
+// security key is available in ssh-agent, loading the token's resident keys
+// if not.
+//
+// Signing with a security key needs a touch, so its probes only check that
+// the key is listed; see KeyEnsurer.VerifyPresence.
+func SecurityKey() *KeyEnsurer {
+	svc := New(IsSecurityKey, nil).Named("fido")
+	svc.KeyLoader = func() error { return residentLoader(svc.Lifetime, svc.run)() }
+	return svc
+}
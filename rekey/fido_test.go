@@ -0,0 +1,91 @@
+package rekey
+
+import (
+	"context"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestSecurityKey_Load(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("yubikey piv"))
+	runner := &rekeytest.Runner{Func: func(cmd *exec.Cmd) error {
+		agent.AddPendingSecurityKey(rekeytest.GenerateSecurityKey("resident"))
+		return agent.Load()
+	}}
+
+	svc := SecurityKey()
+	svc.Dial = agent.Dial
+	svc.Run = runner.Run
+	svc.Lifetime = time.Hour
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, runner.Commands, [][]string{{"ssh-add", "-K", "-t", "3600"}})
+
+	// probes don't sign, so they don't need a touch.
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, len(runner.Commands), 1)
+	assert.Equal(t, agent.Signs, 0)
+}
+
+func TestSecurityKey_PresenceRequired(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	sk := rekeytest.GenerateSecurityKey("fido")
+	agent.AddSecurityKey(sk)
+	svc := New(IsSecurityKey, agent.Load).Named("fido")
+	svc.Dial = agent.Dial
+	svc.VerifyPresence = true
+
+	err := svc.Probe(context.Background())
+	assert.Equal(t, IsPresenceRequired(err), true)
+
+	// the key is loaded; it just wasn't touched.
+	err = svc.EnsureLoaded()
+	assert.Equal(t, IsPresenceRequired(err), true)
+	assert.Equal(t, agent.Loads, 0)
+	report, err := NewGroup(AllOf, svc).Ensure()
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, IsPresenceRequired(report.Failed["fido"]), true)
+	assert.Equal(t, agent.Loads, 0)
+
+	sk.Touch(1)
+	assert.Equal(t, svc.Probe(context.Background()), nil)
+}
+
+func TestProfile_VerifyPresence(t *testing.T) {
+	profile := &Profile{
+		Name:           "fido",
+		Match:          MatchRule{SecurityKey: true},
+		Load:           LoadRule{Resident: true},
+		VerifyPresence: true,
+	}
+	svc, err := profile.Ensurer()
+	assert.Equal(t, err, nil)
+	agent := rekeytest.NewAgent()
+	agent.AddSecurityKey(rekeytest.GenerateSecurityKey("fido"))
+	svc.Dial = agent.Dial
+	assert.Equal(t, IsPresenceRequired(svc.Probe(context.Background())), true)
+}
+
+func TestLoaders_Forever(t *testing.T) {
+	runner := &rekeytest.Runner{}
+	for _, lifetime := range []time.Duration{Forever, 0, time.Hour} {
+		pkcs11Loader("/usr/lib/opensc-pkcs11.so", lifetime, runner.Run)()
+		residentLoader(lifetime, runner.Run)()
+		fileLoader("/home/me/.ssh/id_ed25519_sk", lifetime, runner.Run)()
+	}
+	assert.Equal(t, runner.Commands, [][]string{
+		// Forever keeps the keys until the agent exits.
+		{"ssh-add", "-s", "/usr/lib/opensc-pkcs11.so"},
+		{"ssh-add", "-K"},
+		{"ssh-add", "/home/me/.ssh/id_ed25519_sk"},
+		{"ssh-add", "-s", "/usr/lib/opensc-pkcs11.so", "-t", "14400"},
+		{"ssh-add", "-K", "-t", "14400"},
+		{"ssh-add", "-t", "14400", "/home/me/.ssh/id_ed25519_sk"},
+		{"ssh-add", "-s", "/usr/lib/opensc-pkcs11.so", "-t", "3600"},
+		{"ssh-add", "-K", "-t", "3600"},
+		{"ssh-add", "-t", "3600", "/home/me/.ssh/id_ed25519_sk"},
+	})
+}
@@ -0,0 +1,245 @@
+package rekey
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/justjake/encabulator/keyagent"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FilterPolicy describes which keys a filtered agent socket exposes. Policies
+// are usually declared in the config file:
+//
+//	rekey:
+//	  filters:
+//	    buildbox:
+//	      socket: ~/.encabulator/buildbox.sock
+//	      allow:
+//	        comment: ^deploy@
+//	      confirm: true
+//	    trusted:
+//	      allow:
+//	        all: true
+type FilterPolicy struct {
+	// Name of the policy, as passed to `rekey filter --policy`.
+	Name string
+	// Socket is the path of the unix socket to serve the filtered agent on.
+	Socket string
+	// Allow describes the keys that clients of the socket may list and sign
+	// with. A rule with no fields set is rejected, so that a misspelled rule
+	// doesn't expose every key; set All to allow every key.
+	Allow MatchRule
+	// Confirm asks the user to confirm each signature with SSH_ASKPASS.
+	Confirm bool
+}
+
+// Filter builds the Filter for this policy.
+func (p *FilterPolicy) Filter() (*Filter, error) {
+	if p.Allow.Empty() {
+		return nil, errors.Errorf("Filter policy %s allows no keys: set allow.all to allow every key", p.Name)
+	}
+	rest := p.Allow
+	rest.All = false
+	if p.Allow.All && !rest.Empty() {
+		return nil, errors.Errorf("Filter policy %s: allow.all can't be combined with other rules", p.Name)
+	}
+	allow, err := p.Allow.Predicate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Filter policy %s", p.Name)
+	}
+	filter := NewFilter(allow)
+	if p.Confirm {
+		filter.Confirm = keyagent.AskpassConfirm
+	}
+	return filter, nil
+}
+
+// Filter is an agent that forwards requests to another agent, usually the one
+// behind SSH_AUTH_SOCK, but only lists and signs with the keys it allows.
+// Forward a Filter instead of the real agent to hosts that shouldn't be able
+// to use all of your keys. Every signature is logged, along with the process
+// that asked for it.
+//
+// Requests that change the agent, like Add, Remove, and Lock, are refused.
+//
+// Serve a Filter with keyagent.Listen, using ForConn as the server's AgentFor.
+type Filter struct {
+	// Allow selects the keys that clients may list and sign with.
+	Allow Predicate
+	// Confirm, if set, is called before every signature. Signing is refused
+	// unless it returns true.
+	Confirm func(key ssh.PublicKey, comment string) bool
+	// Logf logs signatures and refusals. Defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+	// Client describes the process using the filter in logs.
+	Client string
+
+	dial func() (net.Conn, error)
+}
+
+// NewFilter returns a Filter that forwards to the agent behind SSH_AUTH_SOCK,
+// and allows keys matching allow.
+func NewFilter(allow Predicate) *Filter {
+	return &Filter{
+		Allow:  allow,
+		Logf:   log.Printf,
+		Client: "unknown client",
+		dial:   dialAgent,
+	}
+}
+
+// ForConn returns a copy of the filter that logs the process on the other end
+// of conn as its client.
+func (f *Filter) ForConn(conn *net.UnixConn) agents.Agent {
+	client := *f
+	pid, err := keyagent.PeerPID(conn)
+	if err != nil {
+		client.Client = fmt.Sprintf("unknown client (%v)", err)
+	} else {
+		client.Client = describeProcess(pid)
+	}
+	return &client
+}
+
+// describeProcess returns the pid and command name of a process, eg
+// "pid 123 (ssh)".
+func describeProcess(pid int) string {
+	name := processName(pid)
+	if name == "" {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	return fmt.Sprintf("pid %d (%s)", pid, name)
+}
+
+// processName returns the command name of a process, or "" if it can't be
+// found.
+func processName(pid int) string {
+	out, err := exec.Command("ps", "-o", "comm=", "-p", fmt.Sprint(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	// macOS prints the full path of the executable.
+	return filepath.Base(strings.TrimSpace(string(out)))
+}
+
+// upstream connects to the real agent. Each request uses its own connection,
+// so that concurrent clients don't share state.
+func (f *Filter) upstream() (agents.ExtendedAgent, func(), error) {
+	conn, err := f.dial()
+	if err != nil {
+		return nil, nil, &AgentUnreachableError{err}
+	}
+	return agents.NewClient(conn), func() { conn.Close() }, nil
+}
+
+// List returns the allowed identities known to the agent.
+func (f *Filter) List() ([]*agents.Key, error) {
+	upstream, done, err := f.upstream()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	keys, err := upstream.List()
+	if err != nil {
+		return nil, err
+	}
+	allowed := []*agents.Key{}
+	for _, key := range keys {
+		if f.Allow(key) {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed, nil
+}
+
+// allowed returns the agent's listing for key, if the key is allowed.
+func (f *Filter) allowed(key ssh.PublicKey) (*agents.Key, error) {
+	keys, err := f.List()
+	if err != nil {
+		return nil, err
+	}
+	blob := key.Marshal()
+	for _, listed := range keys {
+		if bytes.Equal(listed.Blob, blob) {
+			return listed, nil
+		}
+	}
+	return nil, nil
+}
+
+// Sign has the agent sign the data using a protocol 2 key as defined in
+// [PROTOCOL.agent] section 2.6.2.
+func (f *Filter) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return f.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign, if the key is allowed and, with Confirm,
+// the user agrees.
+func (f *Filter) SignWithFlags(key ssh.PublicKey, data []byte, flags agents.SignatureFlags) (*ssh.Signature, error) {
+	listed, err := f.allowed(key)
+	if err != nil {
+		f.Logf("sign %s for %s: %v", Fingerprint(key), f.Client, err)
+		return nil, err
+	}
+	if listed == nil {
+		f.Logf("sign %s for %s: refused, key not allowed", Fingerprint(key), f.Client)
+		return nil, errors.New("Key is not allowed by the filter policy")
+	}
+	if f.Confirm != nil && !f.Confirm(key, listed.Comment) {
+		f.Logf("sign %s (%s) for %s: refused, not confirmed", Fingerprint(key), listed.Comment, f.Client)
+		return nil, errors.New("Signing was not confirmed")
+	}
+	f.Logf("sign %s (%s) for %s", Fingerprint(key), listed.Comment, f.Client)
+
+	upstream, done, err := f.upstream()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return upstream.SignWithFlags(key, data, flags)
+}
+
+var errFilterReadOnly = errors.New("The filtered agent is read-only")
+
+// Add is refused.
+func (f *Filter) Add(key agents.AddedKey) error {
+	return errFilterReadOnly
+}
+
+// Remove is refused.
+func (f *Filter) Remove(key ssh.PublicKey) error {
+	return errFilterReadOnly
+}
+
+// RemoveAll is refused.
+func (f *Filter) RemoveAll() error {
+	return errFilterReadOnly
+}
+
+// Lock is refused.
+func (f *Filter) Lock(passphrase []byte) error {
+	return errFilterReadOnly
+}
+
+// Unlock is refused.
+func (f *Filter) Unlock(passphrase []byte) error {
+	return errFilterReadOnly
+}
+
+// Signers is not supported over a filter, just like over an agent client.
+func (f *Filter) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("Signers are not supported by the rekey filter")
+}
+
+// Extension is not supported, so that clients can't reach past the filter.
+func (f *Filter) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agents.ErrExtensionUnsupported
+}
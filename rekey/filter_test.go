@@ -0,0 +1,98 @@
+package rekey
+
+import (
+	"fmt"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	deploy := rekeytest.GenerateKey("deploy@example")
+	token := rekeytest.GenerateKey("yubikey piv")
+	agent.Add(deploy)
+	agent.Add(token)
+
+	logs := []string{}
+	filter := NewFilter(ByComment(regexp.MustCompile("^deploy@")))
+	filter.dial = agent.Dial
+	filter.Client = "pid 1 (ssh)"
+	filter.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	keys, err := filter.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Comment, "deploy@example")
+
+	_, err = filter.Sign(rekeytest.PublicKey(deploy), []byte("data"))
+	assert.Equal(t, err, nil)
+	_, err = filter.Sign(rekeytest.PublicKey(token), []byte("data"))
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, agent.Signs, 1)
+
+	filter.Confirm = func(key ssh.PublicKey, comment string) bool { return false }
+	_, err = filter.Sign(rekeytest.PublicKey(deploy), []byte("data"))
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, agent.Signs, 1)
+
+	fp := Fingerprint(rekeytest.PublicKey(deploy))
+	assert.Equal(t, logs, []string{
+		"sign " + fp + " (deploy@example) for pid 1 (ssh)",
+		"sign " + Fingerprint(rekeytest.PublicKey(token)) + " for pid 1 (ssh): refused, key not allowed",
+		"sign " + fp + " (deploy@example) for pid 1 (ssh): refused, not confirmed",
+	})
+	assert.Equal(t, filter.RemoveAll(), errFilterReadOnly)
+}
+
+func TestFilterPolicy_FailsClosed(t *testing.T) {
+	_, err := (&FilterPolicy{Name: "typo"}).Filter()
+	assert.Equal(t, err != nil, true)
+	_, err = (&FilterPolicy{Allow: MatchRule{All: true, Comment: "deploy"}}).Filter()
+	assert.Equal(t, err != nil, true)
+
+	filter, err := (&FilterPolicy{Allow: MatchRule{All: true}}).Filter()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, filter.Allow(&agents.Key{Comment: "yubikey"}), true)
+}
+
+func TestFilter_DefaultIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id := writeKey(t, filepath.Join(dir, "id_ed25519"), "me@example", "")
+	// without a .pub file, the key is read from the private key.
+	bare := writeKey(t, filepath.Join(dir, "id_ecdsa"), "bare@example", "")
+	os.Remove(filepath.Join(dir, "id_ecdsa.pub"))
+
+	agent := rekeytest.NewAgent()
+	private, err := readPrivateKey(filepath.Join(dir, "id_ed25519"), nil)
+	assert.Equal(t, err, nil)
+	agent.Add(agents.AddedKey{PrivateKey: private, Comment: "me@example"})
+	private, err = readPrivateKey(filepath.Join(dir, "id_ecdsa"), nil)
+	assert.Equal(t, err, nil)
+	agent.Add(agents.AddedKey{PrivateKey: private, Comment: "bare@example"})
+	agent.Add(rekeytest.GenerateKey("yubikey piv"))
+
+	filter := NewFilter(byKeyFiles([]string{filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_ecdsa")}))
+	filter.dial = agent.Dial
+	filter.Logf = func(format string, args ...interface{}) {}
+	keys, err := filter.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, Fingerprint(keys[0]), Fingerprint(id))
+	assert.Equal(t, Fingerprint(keys[1]), Fingerprint(bare))
+
+	// the token's key isn't one of the user's default identities.
+	assert.Equal(t, DefaultIdentity().KeyPredicate(listed(rekeytest.GenerateKey("yubikey piv"))), false)
+}
@@ -2,13 +2,11 @@ package rekey
 
 import (
 	agents "golang.org/x/crypto/ssh/agent"
-	"os"
 	"regexp"
 )
 
 const (
-	goldkeyLoc1 = "/usr/local/lib/opensc-pkcs11.so"
-	goldkeyLoc2 = "/usr/lib/opensc-pkcs11.so"
+	goldkeyModule = "opensc-pkcs11"
 )
 
 var (
@@ -20,17 +18,22 @@ func IsGoldkey(key *agents.Key) bool {
 	return goldkeyRegexp.MatchString(key.Comment)
 }
 
-// LoadGoldkey loads the Golkey opensc-pkcs11 module into ssh-agent
+// LoadGoldkey loads the Golkey opensc-pkcs11 module into ssh-agent, found
+// with FindModule
 func LoadGoldkey() error {
-	if _, err := os.Stat(goldkeyLoc1); err == nil {
-		return LoadPKCS11(goldkeyLoc1)
-	}
+	return ModuleLoader(goldkeyModule, 0)()
+}
 
-	return LoadPKCS11(goldkeyLoc2)
+// UnloadGoldkey removes the Goldkey opensc-pkcs11 module from ssh-agent
+func UnloadGoldkey() error {
+	return ModuleUnloader(goldkeyModule)()
 }
 
 // Yubikey returns a KeyEnsurer that ensures that a Yubikey SSH token is
 // availible in ssh-agent.
 func Goldkey() *KeyEnsurer {
-	return New(IsGoldkey, LoadGoldkey)
+	svc := New(IsGoldkey, nil).Named("goldkey")
+	svc.KeyLoader = func() error { return moduleLoader(goldkeyModule, svc.Lifetime, svc.run)() }
+	svc.KeyUnloader = moduleUnloader(goldkeyModule, svc.run)
+	return svc
 }
@@ -0,0 +1,99 @@
+package rekey
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// GPGConnectAgentProgram is the program GPGAgent uses to talk to gpg-agent.
+var GPGConnectAgentProgram = "gpg-connect-agent"
+
+var gpgCardRegexp = regexp.MustCompile("^cardno:")
+
+// GPGAgent loads the key on an OpenPGP card for gpg-agent's ssh support. It
+// speaks Assuan to gpg-agent through gpg-connect-agent, asking scdaemon to
+// find the card and gpg-agent to learn its keys, which then show up in the
+// agent behind gpg-agent's ssh socket.
+type GPGAgent struct {
+	// Program is the gpg-connect-agent to run. Empty means
+	// GPGConnectAgentProgram.
+	Program string
+}
+
+// IsGPGCard returns true if the given key is on an OpenPGP card, as listed by
+// gpg-agent.
+func IsGPGCard(key *agents.Key) bool {
+	return gpgCardRegexp.MatchString(key.Comment)
+}
+
+// GPGCard returns a KeyEnsurer that ensures that the key on an OpenPGP card
+// is available through gpg-agent. SSH_AUTH_SOCK must point at gpg-agent's ssh
+// socket.
+func GPGCard() *KeyEnsurer {
+	return New(IsGPGCard, (&GPGAgent{}).Load).Named("gpgcard")
+}
+
+// Load asks gpg-agent to learn the card's keys. If we have a TTY, gpg-agent is
+// told to ask for the card's PIN on it.
+func (g *GPGAgent) Load() error {
+	var env []string
+	tty := gpgTTY()
+	if tty != "" {
+		env = append(os.Environ(), "GPG_TTY="+tty)
+		if err := g.transact(env, "updatestartuptty"); err != nil {
+			return err
+		}
+	}
+	if err := g.transact(env, "scd serialno"); err != nil {
+		return errors.Wrap(err, "No OpenPGP card found")
+	}
+	return g.transact(env, "learn --force")
+}
+
+// transact sends one command to gpg-agent. gpg-connect-agent buffers its
+// output when it isn't a TTY, so each command gets its own gpg-connect-agent,
+// and the response is read after it exits.
+func (g *GPGAgent) transact(env []string, command string) error {
+	program := g.Program
+	if program == "" {
+		program = GPGConnectAgentProgram
+	}
+	cmd := exec.Command(program, command, "/bye")
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.Wrapf(err, "Running %s", program)
+	}
+
+	conn := newAssuanConn(bytes.NewReader(out), ioutil.Discard)
+	if _, err := conn.ReadResponse(); err != nil {
+		return errors.Wrap(err, command)
+	}
+	return nil
+}
+
+// gpgTTY returns the name of our TTY, for gpg-agent's pinentry, or "" if we
+// have none. gpg-connect-agent can't find it itself, because its stdin is a
+// pipe.
+func gpgTTY() string {
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		return tty
+	}
+	if !hasTTY() {
+		return ""
+	}
+	cmd := exec.Command("tty")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,109 @@
+package rekey
+
+import (
+	"context"
+	"github.com/justjake/encabulator/assert"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGPGConnectAgent logs the command it is given to $GPG_LOG, and fails
+// "scd serialno" if GPG_NO_CARD is set.
+const fakeGPGConnectAgent = `#!/bin/sh
+echo "$1" >> "$GPG_LOG"
+case "$1" in
+"scd serialno")
+	if [ -n "$GPG_NO_CARD" ]; then
+		echo "ERR 100696144 No such device <SCD>"
+		exit 0
+	fi
+	echo "S SERIALNO D2760001240102010006123456780000"
+	echo "OK"
+	;;
+*)
+	echo "OK"
+	;;
+esac
+`
+
+func TestGPGAgent_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	os.Setenv("GPG_LOG", log)
+	defer os.Unsetenv("GPG_LOG")
+
+	gpg := &GPGAgent{writeScript(t, dir, "gpg-connect-agent", fakeGPGConnectAgent)}
+	assert.Equal(t, gpg.Load(), nil)
+	commands, _ := ioutil.ReadFile(log)
+	assert.Equal(t, strings.HasSuffix(string(commands), "scd serialno\nlearn --force\n"), true)
+
+	os.Setenv("GPG_NO_CARD", "1")
+	defer os.Unsetenv("GPG_NO_CARD")
+	err = gpg.Load()
+	_, ok := errors.Cause(err).(*AssuanError)
+	assert.Equal(t, ok, true)
+}
+
+// TestGPGAgent_Real runs a gpg-agent with ssh support, and checks GPGCard
+// against its ssh socket. There is no card, so GPGCard fails until a soft key
+// with a card's comment is imported through the socket, and then finds it.
+func TestGPGAgent_Real(t *testing.T) {
+	if _, err := exec.LookPath("gpg-agent"); err != nil {
+		t.Skip("gpg-agent is not installed")
+	}
+	if _, err := exec.LookPath("gpgconf"); err != nil {
+		t.Skip("gpgconf is not installed")
+	}
+	dir, err := ioutil.TempDir("", "rekey-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv("GNUPGHOME", dir)()
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+
+	pinentry := writeScript(t, dir, "pinentry", fakePinentry)
+	conf := "enable-ssh-support\npinentry-program " + pinentry + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "gpg-agent.conf"), []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("gpgconf", "--launch", "gpg-agent").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("gpgconf", "--list-dirs", "agent-ssh-socket").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := strings.TrimSpace(string(out))
+	dial := func() (net.Conn, error) { return net.Dial("unix", sock) }
+
+	card := GPGCard()
+	card.Dial = dial
+	card.ProbeTimeout = 10 * time.Second
+	_, missing := card.Probe(context.Background()).(*KeyMissingError)
+	assert.Equal(t, missing, true)
+	_, ok := errors.Cause(card.EnsureLoaded()).(*AssuanError)
+	assert.Equal(t, ok, true)
+
+	// gpg-agent lists a card's keys with a "cardno:" comment.
+	writeKey(t, filepath.Join(dir, "id_card"), "cardno:000612345678", "")
+	loader := &KeyFileLoader{Paths: []string{filepath.Join(dir, "id_card")}, Dial: dial}
+	assert.Equal(t, loader.Load(), nil)
+
+	assert.Equal(t, card.EnsureLoaded(), nil)
+	loaded, err := card.KeyIsLoaded()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loaded, true)
+}
@@ -0,0 +1,190 @@
+package rekey
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// Mode decides how many of a Group's keys must be loaded.
+type Mode int
+
+const (
+	// AllOf requires every key in the group to be loaded.
+	AllOf Mode = iota
+	// AnyOf requires at least one key in the group to be loaded.
+	AnyOf
+)
+
+// Group ensures several keys at once. Every key is probed once up front, then
+// the missing keys are loaded in order. Keys that are about to expire are
+// refreshed.
+type Group struct {
+	Mode     Mode
+	Ensurers []*KeyEnsurer
+	// Restart, if set, restarts ssh-agent before any key is loaded. Because
+	// this drops the keys that were already present, every key in the group is
+	// loaded again afterwards. Keys that could not be probed, for example
+	// because no agent is running, are treated as missing.
+	Restart func() error
+	// Lock, if set, is held while keys are loaded. After taking it, every key
+	// is probed again, since another process may have loaded them meanwhile.
+	Lock *FileLock
+}
+
+// Report describes the outcome of ensuring a Group.
+type Report struct {
+	// Present lists the keys that were already loaded.
+	Present []string
+	// Loaded lists the keys that were loaded by this run.
+	Loaded []string
+	// Failed maps the keys that could not be loaded to the reason why.
+	Failed map[string]error
+	// Stale maps the keys that are loaded but about to expire, and could not
+	// be refreshed, to the reason why.
+	Stale map[string]error
+}
+
+// NewGroup returns a Group of the given ensurers.
+func NewGroup(mode Mode, ensurers ...*KeyEnsurer) *Group {
+	return &Group{Mode: mode, Ensurers: ensurers}
+}
+
+// Ensure loads the group's keys. The returned Report is always non-nil. An
+// error is returned if the group's Mode was not satisfied.
+func (g *Group) Ensure() (*Report, error) {
+	report, missing, expiring := g.probe()
+	if g.satisfied(report, missing) {
+		return report, g.check(report)
+	}
+
+	if g.Lock != nil {
+		if err := g.Lock.Lock(); err != nil {
+			return report, err
+		}
+		defer g.Lock.Unlock()
+		for _, svc := range g.Ensurers {
+			// the agent may have been restarted while we waited.
+			svc.disconnect()
+			if svc.State == nil {
+				continue
+			}
+			if err := svc.State.Reload(); err != nil {
+				return report, err
+			}
+		}
+		report, missing, expiring = g.probe()
+		if g.satisfied(report, missing) {
+			return report, g.check(report)
+		}
+	}
+
+	if g.Restart != nil {
+		if err := g.Restart(); err != nil {
+			return report, errors.Wrap(err, "Restarting ssh-agent")
+		}
+		report.Present = nil
+		missing = g.Ensurers
+		expiring = nil
+		for _, svc := range missing {
+			svc.disconnect()
+			delete(report.Failed, svc.String())
+		}
+	}
+
+	for _, svc := range missing {
+		if expiring[svc] {
+			unloaded, err := svc.refresh()
+			if err != nil && unloaded {
+				report.Failed[svc.String()] = err
+				continue
+			}
+			if err != nil {
+				// the key still works until it expires.
+				report.Present = append(report.Present, svc.String())
+				report.Stale[svc.String()] = err
+				continue
+			}
+		} else if err := svc.load(); err != nil {
+			report.Failed[svc.String()] = err
+			continue
+		}
+		report.Loaded = append(report.Loaded, svc.String())
+		if g.Mode == AnyOf {
+			break
+		}
+	}
+
+	return report, g.check(report)
+}
+
+// probe probes every key, and returns the keys that need loading, and which of
+// those are only expiring.
+func (g *Group) probe() (*Report, []*KeyEnsurer, map[*KeyEnsurer]bool) {
+	report := &Report{Failed: make(map[string]error), Stale: make(map[string]error)}
+	missing := []*KeyEnsurer{}
+	expiring := make(map[*KeyEnsurer]bool)
+	for _, svc := range g.Ensurers {
+		err := svc.Probe(context.Background())
+		switch {
+		case err == nil && svc.Expiring(svc.now()):
+			expiring[svc] = true
+			missing = append(missing, svc)
+		case err == nil:
+			report.Present = append(report.Present, svc.String())
+		case IsUnreachable(err) && g.Restart == nil, IsPresenceRequired(err):
+			report.Failed[svc.String()] = err
+		default:
+			missing = append(missing, svc)
+		}
+	}
+	return report, missing, expiring
+}
+
+// satisfied returns true if nothing needs to be loaded.
+func (g *Group) satisfied(report *Report, missing []*KeyEnsurer) bool {
+	return len(missing) == 0 || (g.Mode == AnyOf && len(report.Present) > 0)
+}
+
+func (g *Group) check(report *Report) error {
+	satisfied := len(report.Present) + len(report.Loaded)
+	if g.Mode == AnyOf && satisfied > 0 {
+		return nil
+	}
+	if g.Mode == AllOf && len(report.Failed) == 0 {
+		return nil
+	}
+	return errors.Errorf("Keys not loaded: %s", strings.Join(report.failedNames(), ", "))
+}
+
+func (r *Report) failedNames() []string {
+	return sortedNames(r.Failed)
+}
+
+func sortedNames(errs map[string]error) []string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Report) String() string {
+	lines := []string{}
+	if len(r.Present) > 0 {
+		lines = append(lines, fmt.Sprintf("Already loaded: %s", strings.Join(r.Present, ", ")))
+	}
+	if len(r.Loaded) > 0 {
+		lines = append(lines, fmt.Sprintf("Loaded: %s", strings.Join(r.Loaded, ", ")))
+	}
+	for _, name := range r.failedNames() {
+		lines = append(lines, fmt.Sprintf("Failed: %s: %v", name, r.Failed[name]))
+	}
+	for _, name := range sortedNames(r.Stale) {
+		lines = append(lines, fmt.Sprintf("Not refreshed: %s: %v", name, r.Stale[name]))
+	}
+	return strings.Join(lines, "\n")
+}
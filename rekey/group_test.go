@@ -0,0 +1,98 @@
+package rekey
+
+import (
+	"errors"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// member returns a KeyEnsurer for the key commented name, whose loader records
+// its name in loads, and adds the key unless fail is set.
+func member(agent *rekeytest.Agent, name string, loads *[]string, fail bool) *KeyEnsurer {
+	svc := New(ByComment(regexp.MustCompile("^"+name+"$")), func() error {
+		*loads = append(*loads, name)
+		if fail {
+			return errors.New("token unplugged")
+		}
+		return agent.Add(rekeytest.GenerateKey(name))
+	}).Named(name)
+	svc.Dial = agent.Dial
+	svc.ProbeTimeout = time.Second
+	return svc
+}
+
+func TestGroup_AnyOf(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("b"))
+	loads := []string{}
+	a := member(agent, "a", &loads, false)
+	b := member(agent, "b", &loads, false)
+
+	// one loaded member is enough.
+	report, err := NewGroup(AnyOf, a, b).Ensure()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, report.Present, []string{"b"})
+	assert.Equal(t, len(loads), 0)
+
+	// otherwise members are tried in order, until one loads.
+	agent.RemoveAll()
+	c := member(agent, "c", &loads, true)
+	report, err = NewGroup(AnyOf, c, a, b).Ensure()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loads, []string{"c", "a"})
+	assert.Equal(t, report.Loaded, []string{"a"})
+	assert.Equal(t, len(report.Failed), 1)
+
+	// none loads.
+	agent.RemoveAll()
+	loads = loads[:0]
+	_, err = NewGroup(AnyOf, c, member(agent, "d", &loads, true)).Ensure()
+	assert.Equal(t, err.Error(), "Keys not loaded: c, d")
+	assert.Equal(t, loads, []string{"c", "d"})
+}
+
+func TestGroup_AllOf(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("b"))
+	loads := []string{}
+	a := member(agent, "a", &loads, false)
+	b := member(agent, "b", &loads, false)
+	c := member(agent, "c", &loads, false)
+
+	// the missing members are loaded in the group's order.
+	report, err := NewGroup(AllOf, c, b, a).Ensure()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loads, []string{"c", "a"})
+	assert.Equal(t, report.Present, []string{"b"})
+	assert.Equal(t, report.Loaded, []string{"c", "a"})
+
+	// a failure doesn't stop the members after it.
+	agent.RemoveAll()
+	loads = loads[:0]
+	d := member(agent, "d", &loads, true)
+	report, err = NewGroup(AllOf, d, a).Ensure()
+	assert.Equal(t, err.Error(), "Keys not loaded: d")
+	assert.Equal(t, loads, []string{"d", "a"})
+	assert.Equal(t, report.Loaded, []string{"a"})
+}
+
+func TestReport_String(t *testing.T) {
+	report := &Report{
+		Present: []string{"id", "gpgcard"},
+		Loaded:  []string{"yubikey"},
+		Failed: map[string]error{
+			"work": errors.New("cancelled"),
+			"fido": errors.New("token unplugged"),
+		},
+		Stale: map[string]error{"home": errors.New("cancelled")},
+	}
+	assert.Equal(t, report.String(), `Already loaded: id, gpgcard
+Loaded: yubikey
+Failed: fido: token unplugged
+Failed: work: cancelled
+Not refreshed: home: cancelled`)
+	assert.Equal(t, (&Report{}).String(), "")
+}
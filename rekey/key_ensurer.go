@@ -1,106 +1,299 @@
 package rekey
 
 import (
-	"fmt"
+	"context"
 	"github.com/pkg/errors"
 	agents "golang.org/x/crypto/ssh/agent"
+	"net"
+	"os/exec"
+	"time"
 )
 
-// This data is used to test key signing.
-var signedData = []byte("")
-
 // KeyEnsurer is a service object that ensures that the active SSH agent has
 // matching keys loaded
 type KeyEnsurer struct {
+	// Name describes the key in reports and error messages.
+	Name string
 	// If a key matching this predicate is not found, or if signing with it
 	// returns an error, we will attempt to re-add the key to the agent using the
 	// KeyLoader.
-	KeyPredicate func(key *agents.Key) bool
+	KeyPredicate Predicate
 	// A function that attempts to load the key into ssh-agent
 	KeyLoader func() error
-	agent     agents.Agent
+	// KeyUnloader, if set, removes the key from ssh-agent before it is
+	// refreshed. Loaders that can't replace a key that is already loaded, like
+	// `ssh-add -s`, need one.
+	KeyUnloader func() error
+	// ProbeTimeout bounds each probe of the agent. Zero uses
+	// DefaultProbeTimeout.
+	ProbeTimeout time.Duration
+	// Lifetime is how long ssh-agent keeps the key after KeyLoader adds it.
+	// Zero means DefaultLifetime, and Forever means until the agent exits.
+	Lifetime time.Duration
+	// State, if set, records when the key is loaded, so that rekey knows when
+	// it will expire.
+	State *State
+	// RefreshBefore reloads a key that will expire within this duration, even
+	// though it is still usable. Zero disables refreshing. Requires State.
+	RefreshBefore time.Duration
+	// ProbeCacheTTL skips signing when probing a key that signed a probe this
+	// recently; the agent is only asked whether the key is listed. This saves
+	// touches on tokens that require them. Zero always signs. Requires State.
+	ProbeCacheTTL time.Duration
+	// VerifyPresence signs probes with FIDO security keys too, which needs a
+	// touch each time. Otherwise they are only checked for in the agent's
+	// key list. A probe that isn't touched fails with PresenceRequiredError.
+	VerifyPresence bool
+	// Lock, if set, is held while the key is loaded, so that concurrent rekeys
+	// load it once. Share one Lock between KeyEnsurers that may prompt.
+	Lock *FileLock
+
+	// Dial connects to ssh-agent. Nil dials SSH_AUTH_SOCK.
+	Dial func() (net.Conn, error)
+	// Run runs the commands of loaders built by this package, like ssh-add.
+	// Nil runs them connected to our stdio.
+	Run func(cmd *exec.Cmd) error
+	// Now tells the time when tracking expiry. Nil uses time.Now.
+	Now func() time.Time
+	// Restart restarts ssh-agent for EnsureRestartingAgent. Nil uses
+	// RestartAgent.
+	Restart func() error
+
+	agent agents.Agent
+	conn  net.Conn
 }
 
 // KeyEnsurer creates a new KeyEnsurer.
-func New(predicate func(key *agents.Key) bool, loader func() error) *KeyEnsurer {
+func New(predicate Predicate, loader func() error) *KeyEnsurer {
 	return &KeyEnsurer{
-		predicate,
-		loader,
-		nil,
+		KeyPredicate: predicate,
+		KeyLoader:    loader,
+	}
+}
+
+// Named sets the name of this KeyEnsurer, and returns the KeyEnsurer.
+func (svc *KeyEnsurer) Named(name string) *KeyEnsurer {
+	svc.Name = name
+	return svc
+}
+
+func (svc *KeyEnsurer) String() string {
+	if svc.Name == "" {
+		return "key"
 	}
+	return svc.Name
 }
 
 // KeyIsLoaded establishes a connection to ssh-agent and queries it for this
 // key, returning if the key is present, or if an error occured while querying
-// ssh-agent
+// ssh-agent. Use Probe to find out why a key is not loaded.
 func (svc *KeyEnsurer) KeyIsLoaded() (bool, error) {
-	if (svc.agent) == nil {
-		agent, err := ConnectAgent()
+	err := svc.Probe(context.Background())
+	if err == nil {
+		return true, nil
+	}
+	if IsUnreachable(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+// EnsureLoaded ensures the key is loaded, and refreshes it if it will expire
+// soon. On success returns nil, otherwise returns an error.
+func (svc *KeyEnsurer) EnsureLoaded() error {
+	err := svc.Probe(context.Background())
+	if err == nil && !svc.Expiring(svc.now()) {
+		return nil
+	}
+	if IsUnreachable(err) || IsPresenceRequired(err) {
+		// loading the key again won't help.
+		return errors.Wrap(err, "Probe")
+	}
+	return svc.ensure(context.Background(), err)
+}
+
+// ensure loads or refreshes the key, given the result of a probe. If there is
+// a Lock, it is taken first, and the key probed again, because another process
+// may have loaded the key while we waited.
+func (svc *KeyEnsurer) ensure(ctx context.Context, probed error) error {
+	if svc.Lock != nil {
+		unlock, err := svc.lock()
 		if err != nil {
-			return false, errors.Wrap(err, "Connecting to agent")
+			return err
 		}
-		svc.agent = agent
+		defer unlock()
+		probed = svc.Probe(ctx)
 	}
 
-	// search keys for
-	key, err := FindKey(svc.agent, IsYubikey)
-	if err != nil {
-		return false, errors.Wrap(err, "Finding key")
+	switch {
+	case probed == nil && svc.Expiring(svc.now()):
+		_, err := svc.refresh()
+		return err
+	case probed == nil:
+		return nil
+	case IsUnreachable(probed), IsPresenceRequired(probed):
+		return errors.Wrap(probed, "Probe")
 	}
-	if key == nil {
-		return false, nil
+	return svc.load()
+}
+
+// lock takes the Lock, and reloads the State so that it includes loads by the
+// process that held the lock before us.
+func (svc *KeyEnsurer) lock() (func(), error) {
+	if err := svc.Lock.Lock(); err != nil {
+		return nil, err
 	}
+	// the agent may have been restarted while we waited.
+	svc.disconnect()
+	if svc.State != nil {
+		if err := svc.State.Reload(); err != nil {
+			svc.Lock.Unlock()
+			return nil, err
+		}
+	}
+	return func() { svc.Lock.Unlock() }, nil
+}
 
-	_, err = svc.agent.Sign(key, signedData)
-	if err != nil {
-		return false, nil
+// Expires returns when the key will expire from the agent, if it was loaded
+// by a KeyEnsurer sharing this State.
+func (svc *KeyEnsurer) Expires() (time.Time, bool) {
+	if svc.State == nil {
+		return time.Time{}, false
 	}
+	return svc.State.Expires(svc.String())
+}
 
-	return true, nil
+// Expiring returns true if the key will expire within RefreshBefore of now.
+func (svc *KeyEnsurer) Expiring(now time.Time) bool {
+	expires, ok := svc.Expires()
+	return ok && svc.RefreshBefore > 0 && expires.Sub(now) < svc.RefreshBefore
 }
 
-// EnsureLoaded ensures the key is loaded. On success returns nil, otherwise
-// returns an error.
-func (svc *KeyEnsurer) EnsureLoaded() error {
-	loaded, err := svc.KeyIsLoaded()
-	if err != nil {
-		return errors.Wrap(err, "KeyIsLoaded")
-	}
-	if loaded {
-		return nil
+// lifetime returns how long the agent keeps the key.
+func (svc *KeyEnsurer) lifetime() time.Duration {
+	if svc.Lifetime <= 0 {
+		return DefaultLifetime
 	}
+	return svc.Lifetime
+}
 
-	err = svc.KeyLoader()
+// load runs the KeyLoader, and then checks that the key was loaded.
+func (svc *KeyEnsurer) load() error {
+	err := svc.KeyLoader()
 	if err != nil {
 		return errors.Wrap(err, "KeyLoader")
 	}
 
-	loaded, err = svc.KeyIsLoaded()
+	err = svc.Probe(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "KeyIsLoaded after loading the key")
+		return errors.Wrap(err, "Key still not usable after calling loader")
+	}
+
+	if svc.State != nil {
+		if svc.Lifetime == Forever {
+			delete(svc.State.Keys, svc.String())
+		} else {
+			svc.State.Loaded(svc.String(), svc.lifetime(), svc.now())
+		}
+		if err := svc.State.Save(); err != nil {
+			return err
+		}
 	}
-	if loaded {
+	return nil
+}
+
+// refresh loads a key that is still loaded, to reset its lifetime. Returns
+// true if the KeyUnloader ran, in which case the key is gone if the load
+// failed.
+func (svc *KeyEnsurer) refresh() (bool, error) {
+	if svc.KeyUnloader != nil {
+		if err := svc.KeyUnloader(); err != nil {
+			return false, errors.Wrap(err, "KeyUnloader")
+		}
+		return true, svc.load()
+	}
+	return false, svc.load()
+}
+
+func (svc *KeyEnsurer) dial() (net.Conn, error) {
+	if svc.Dial != nil {
+		return svc.Dial()
+	}
+	return dialAgent()
+}
+
+func (svc *KeyEnsurer) run(cmd *exec.Cmd) error {
+	if svc.Run != nil {
+		return svc.Run(cmd)
+	}
+	return runInteractive(cmd)
+}
+
+func (svc *KeyEnsurer) now() time.Time {
+	if svc.Now != nil {
+		return svc.Now()
+	}
+	return time.Now()
+}
+
+func (svc *KeyEnsurer) restart() error {
+	if svc.Restart != nil {
+		return svc.Restart()
+	}
+	return RestartAgent()
+}
+
+// connect establishes a connection to ssh-agent, if there isn't one already.
+func (svc *KeyEnsurer) connect() error {
+	if svc.agent != nil {
 		return nil
 	}
-	return fmt.Errorf("Key still not loaded after calling loader %#v", svc.KeyLoader)
+	conn, err := svc.dial()
+	if err != nil {
+		return errors.Wrap(err, "Connecting to agent")
+	}
+	svc.conn = conn
+	svc.agent = agents.NewClient(conn)
+	return nil
+}
+
+// disconnect drops the connection to ssh-agent, so that the next query
+// reconnects. This is needed after the agent restarts.
+func (svc *KeyEnsurer) disconnect() {
+	if svc.conn != nil {
+		svc.conn.Close()
+	}
+	svc.conn = nil
+	svc.agent = nil
 }
 
 // EnsureRestartingAgent creates a new KeyEnsurer that will restart SSH agent
-// before trying to load a key. This works on macOS because ssh-agent runs as a
-// user daemon, and SSH_AUTH_SOCK is always updated to the current socket path.
-// Your milage may vary on other operating systems.
+// before trying to load a key. Only the agent behind SSH_AUTH_SOCK is
+// restarted; see AgentRestarter. Set Restart to restart it some other way.
 func EnsureRestartingAgent(svc *KeyEnsurer) *KeyEnsurer {
 	copy := &KeyEnsurer{
-		svc.KeyPredicate,
-		svc.KeyLoader,
-		svc.agent,
+		Name:           svc.Name,
+		KeyPredicate:   svc.KeyPredicate,
+		KeyLoader:      svc.KeyLoader,
+		KeyUnloader:    svc.KeyUnloader,
+		ProbeTimeout:   svc.ProbeTimeout,
+		Lifetime:       svc.Lifetime,
+		State:          svc.State,
+		RefreshBefore:  svc.RefreshBefore,
+		ProbeCacheTTL:  svc.ProbeCacheTTL,
+		VerifyPresence: svc.VerifyPresence,
+		Lock:           svc.Lock,
+		Dial:           svc.Dial,
+		Run:            svc.Run,
+		Now:            svc.Now,
+		Restart:        svc.Restart,
 	}
 
 	loader := func() error {
-		if err := KillSSHAgent(); err != nil {
-			return errors.Wrap(err, "Killing ssh-agent")
+		if err := copy.restart(); err != nil {
+			return errors.Wrap(err, "Restarting ssh-agent")
 		}
-		copy.agent = nil
+		copy.disconnect()
 		return svc.KeyLoader()
 	}
 	copy.KeyLoader = loader
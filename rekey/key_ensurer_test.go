@@ -0,0 +1,272 @@
+package rekey
+
+import (
+	"context"
+	"errors"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func fakeEnsurer(agent *rekeytest.Agent) *KeyEnsurer {
+	svc := New(Any, agent.Load).Named("fake")
+	svc.Dial = agent.Dial
+	svc.ProbeTimeout = time.Second
+	return svc
+}
+
+func TestKeyEnsurer_EnsureLoaded(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	svc := fakeEnsurer(agent)
+
+	_, missing := svc.Probe(context.Background()).(*KeyMissingError)
+	assert.Equal(t, missing, true)
+
+	agent.AddPending(rekeytest.GenerateKey("fake"))
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, agent.Loads, 1)
+
+	// already loaded.
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, agent.Loads, 1)
+}
+
+func TestKeyEnsurer_SignFailure(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("fake"))
+	svc := fakeEnsurer(agent)
+
+	agent.FailSigns(1)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, agent.Loads, 1)
+	assert.Equal(t, agent.Signs, 2)
+
+	// the loader can't fix a key that never signs.
+	agent.FailSigns(2)
+	err := svc.EnsureLoaded()
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, agent.Loads, 2)
+}
+
+func TestKeyEnsurer_Unreachable(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("fake"))
+	svc := fakeEnsurer(agent)
+
+	agent.SetDelay(time.Second)
+	svc.ProbeTimeout = 10 * time.Millisecond
+	assert.Equal(t, IsUnreachable(svc.EnsureLoaded()), true)
+	assert.Equal(t, agent.Loads, 0)
+
+	agent.SetDelay(0)
+	agent.Stop()
+	svc.ProbeTimeout = time.Second
+	loaded, err := svc.KeyIsLoaded()
+	assert.Equal(t, loaded, false)
+	assert.Equal(t, IsUnreachable(err), true)
+
+	// restarting brings the agent back, without its keys.
+	restarting := EnsureRestartingAgent(svc)
+	restarting.Restart = agent.Restart
+	agent.AddPending(rekeytest.GenerateKey("fake"))
+	assert.Equal(t, restarting.load(), nil)
+}
+
+func TestKeyEnsurer_Refresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-ensurer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path []string) { ModuleSearchPath = path }(ModuleSearchPath)
+	ModuleSearchPath = []string{dir}
+	module := writeScript(t, dir, "libykcs11.so", "")
+
+	agent := rekeytest.NewAgent()
+	token := rekeytest.GenerateKey("libykcs11")
+	runner := &rekeytest.Runner{Func: func(cmd *exec.Cmd) error {
+		agent.AddPending(token)
+		return agent.Load()
+	}}
+	clock := rekeytest.NewClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	svc := Yubikey()
+	svc.Dial = agent.Dial
+	svc.Run = runner.Run
+	svc.Now = clock.Now
+	svc.Lifetime = time.Hour
+	svc.RefreshBefore = 10 * time.Minute
+	svc.State, err = LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, runner.Commands, [][]string{{"ssh-add", "-s", module, "-t", "3600"}})
+
+	clock.Advance(30 * time.Minute)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, len(runner.Commands), 1)
+
+	clock.Advance(25 * time.Minute)
+	assert.Equal(t, svc.EnsureLoaded(), nil)
+	assert.Equal(t, runner.Commands[1:], [][]string{
+		{"ssh-add", "-e", module},
+		{"ssh-add", "-s", module, "-t", "3600"},
+	})
+	expires, _ := svc.Expires()
+	assert.Equal(t, expires, clock.Now().Add(time.Hour))
+}
+
+func TestGroup_RefreshFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-ensurer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := rekeytest.NewAgent()
+	token := rekeytest.GenerateKey("token")
+	agent.Add(token)
+	clock := rekeytest.NewClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	svc := fakeEnsurer(agent)
+	svc.Now = clock.Now
+	svc.Lifetime = time.Hour
+	svc.RefreshBefore = 10 * time.Minute
+	svc.State, err = LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+	svc.State.Loaded(svc.String(), time.Hour, clock.Now())
+	clock.Advance(55 * time.Minute)
+
+	// the PIN prompt was cancelled after the old key was removed.
+	svc.KeyUnloader = func() error { return agent.Remove(rekeytest.PublicKey(token)) }
+	svc.KeyLoader = func() error { return errors.New("cancelled") }
+	report, err := NewGroup(AllOf, svc).Ensure()
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, len(report.Present), 0)
+	assert.Equal(t, report.Failed["fake"] != nil, true)
+
+	// without an unloader, the old key still works until it expires.
+	agent.Add(token)
+	svc.KeyUnloader = nil
+	report, err = NewGroup(AllOf, svc).Ensure()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, report.Present, []string{"fake"})
+	assert.Equal(t, report.Stale["fake"] != nil, true)
+}
+
+func TestKeyEnsurer_ProbeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-ensurer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("fake"))
+	clock := rekeytest.NewClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	svc := fakeEnsurer(agent)
+	svc.Now = clock.Now
+	svc.ProbeCacheTTL = time.Minute
+	svc.State, err = LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, svc.Probe(context.Background()), nil)
+	assert.Equal(t, agent.Signs, 1)
+
+	// within the TTL, only the list is checked, even by another process.
+	clock.Advance(30 * time.Second)
+	other := fakeEnsurer(agent)
+	other.Now = clock.Now
+	other.ProbeCacheTTL = time.Minute
+	other.State, err = LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, other.Probe(context.Background()), nil)
+	assert.Equal(t, agent.Signs, 1)
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, svc.Probe(context.Background()), nil)
+	assert.Equal(t, agent.Signs, 2)
+
+	// a missing key is noticed right away.
+	agent.RemoveAll()
+	_, missing := svc.Probe(context.Background()).(*KeyMissingError)
+	assert.Equal(t, missing, true)
+
+	// a different key with the same name is signed with.
+	agent.Add(rekeytest.GenerateKey("fake"))
+	assert.Equal(t, svc.Probe(context.Background()), nil)
+	assert.Equal(t, agent.Signs, 3)
+}
+
+func TestKeyEnsurer_Unload(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	for _, comment := range []string{"fake", "fake", "other"} {
+		agent.Add(rekeytest.GenerateKey(comment))
+	}
+	svc := New(ByComment(regexp.MustCompile("^fake$")), agent.Load).Named("fake")
+	svc.Dial = agent.Dial
+	unloaded := 0
+	svc.KeyUnloader = func() error {
+		unloaded++
+		return nil
+	}
+
+	n, err := svc.Unload()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, unloaded, 1)
+	keys, _ := agent.List()
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Comment, "other")
+
+	// nothing to unload.
+	n, err = svc.Unload()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 0)
+	assert.Equal(t, unloaded, 1)
+}
+
+func TestKeyEnsurer_UnloaderFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-unload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	agent := rekeytest.NewAgent()
+	agent.Add(rekeytest.GenerateKey("fake"))
+	svc := fakeEnsurer(agent)
+	svc.KeyUnloader = func() error { return errors.New("ssh-add -e failed") }
+	svc.State, err = LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+	svc.State.Loaded("fake", time.Hour, time.Now())
+	assert.Equal(t, svc.State.Save(), nil)
+	svc.Lock = &FileLock{Path: filepath.Join(dir, "rekey.lock"), Timeout: 100 * time.Millisecond}
+
+	// the state is saved under the lock, so a rekey holding it blocks Unload.
+	other := NewFileLock(svc.Lock.Path)
+	assert.Equal(t, other.Lock(), nil)
+	n, err := svc.Unload()
+	_, timedOut := err.(*LockTimeoutError)
+	assert.Equal(t, timedOut, true)
+	assert.Equal(t, other.Unlock(), nil)
+
+	// the keys were removed one by one anyway.
+	assert.Equal(t, n, 1)
+	keys, _ := agent.List()
+	assert.Equal(t, len(keys), 0)
+
+	agent.Add(rekeytest.GenerateKey("fake"))
+	n, err = svc.Unload()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 1)
+	state, err := LoadState(filepath.Join(dir, "state.json"))
+	assert.Equal(t, err, nil)
+	_, ok := state.Expires("fake")
+	assert.Equal(t, ok, false)
+}
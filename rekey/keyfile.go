@@ -0,0 +1,285 @@
+package rekey
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultKeyFiles are the default identities, in the order `ssh-add` loads
+// them. They're fixed names rather than a glob, so that backups like
+// id_rsa.old aren't loaded.
+var DefaultKeyFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ecdsa_sk",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ed25519_sk",
+	"~/.ssh/id_xmss",
+	"~/.ssh/id_dsa",
+}
+
+const (
+	// passphraseAttempts is how many times KeyFileLoader asks for a
+	// passphrase before giving up on a key.
+	passphraseAttempts = 3
+)
+
+// KeyFileLoader loads private key files into ssh-agent itself, instead of
+// running ssh-add, so that it controls which files load and how. Encrypted
+// keys are decrypted with a passphrase from the Prompter.
+//
+// Keys for hardware security keys (id_*_sk) can't be parsed, and need
+// FileLoader instead.
+type KeyFileLoader struct {
+	// Paths lists the key files to load, and may contain globs. Empty means
+	// DefaultKeyFiles. Public keys, security keys (id_*_sk), and files that
+	// aren't private keys are skipped.
+	Paths []string
+	// Lifetime is how long the agent keeps the keys. Zero means
+	// DefaultLifetime, and Forever means until the agent exits.
+	Lifetime time.Duration
+	// Confirm asks the agent to confirm each use of the keys, which needs
+	// ssh-askpass to be installed where the agent runs.
+	Confirm bool
+	// Certificates lists OpenSSH certificate files. Each key is also added
+	// with each certificate issued for it, and with its own -cert.pub file,
+	// like ssh-add does.
+	Certificates []string
+	// Prompter asks for passphrases. Nil uses NewPrompter.
+	Prompter Prompter
+	// Dial connects to ssh-agent for Load. Nil dials SSH_AUTH_SOCK.
+	Dial func() (net.Conn, error)
+}
+
+func globKeyFiles(patterns []string) ([]string, error) {
+	paths := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(ExpandHome(pattern))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad key path %s", pattern)
+		}
+		sort.Strings(matches)
+		for _, path := range matches {
+			if strings.HasSuffix(path, ".pub") || strings.HasSuffix(path, "_sk") || !isPrivateKeyFile(path) {
+				continue
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// isPrivateKeyFile returns true if path holds a PEM-encoded private key, in
+// OpenSSH's format or an older one, so that globs skip files like PuTTY's
+// id_rsa.ppk. A backup like id_rsa.old is still a private key, and matches.
+func isPrivateKeyFile(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	return block != nil && strings.HasSuffix(block.Type, "PRIVATE KEY")
+}
+
+// lifetimeSecs converts a lifetime to an agent constraint, where 0 means
+// forever.
+func lifetimeSecs(lifetime time.Duration) uint32 {
+	switch {
+	case lifetime == Forever:
+		return 0
+	case lifetime <= 0:
+		lifetime = DefaultLifetime
+	}
+	return uint32(lifetime / time.Second)
+}
+
+// Load adds the keys to the agent behind SSH_AUTH_SOCK.
+func (l *KeyFileLoader) Load() error {
+	dial := l.Dial
+	if dial == nil {
+		dial = dialAgent
+	}
+	conn, err := dial()
+	if err != nil {
+		return &AgentUnreachableError{err}
+	}
+	defer conn.Close()
+	return l.LoadInto(agents.NewClient(conn))
+}
+
+// LoadInto adds the keys to the given agent. Every key is tried; if any fail,
+// the first error is returned.
+func (l *KeyFileLoader) LoadInto(agent agents.Agent) error {
+	patterns := l.Paths
+	if len(patterns) == 0 {
+		patterns = DefaultKeyFiles
+	}
+	paths, err := globKeyFiles(patterns)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errors.Errorf("No private keys found in %s", strings.Join(patterns, ", "))
+	}
+
+	var firstErr error
+	for _, path := range paths {
+		key, err := l.parse(path)
+		if err == nil {
+			err = agent.Add(agents.AddedKey{
+				PrivateKey:       key,
+				Comment:          keyComment(path),
+				LifetimeSecs:     lifetimeSecs(l.Lifetime),
+				ConfirmBeforeUse: l.Confirm,
+			})
+		}
+		if err == nil {
+			err = l.addCertificates(agent, key, path)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Loading %s", path)
+		}
+	}
+	return firstErr
+}
+
+// addCertificates adds key to the agent again with each of the Certificates
+// issued for it, and with the key's -cert.pub file if there is one.
+func (l *KeyFileLoader) addCertificates(agent agents.Agent, key interface{}, path string) error {
+	certPaths := l.Certificates
+	if _, err := os.Stat(path + "-cert.pub"); err == nil {
+		certPaths = append(append([]string{}, certPaths...), path+"-cert.pub")
+	}
+	if len(certPaths) == 0 {
+		return nil
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, certPath := range certPaths {
+		if seen[ExpandHome(certPath)] {
+			continue
+		}
+		seen[ExpandHome(certPath)] = true
+		cert, err := readCertificate(ExpandHome(certPath))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+			continue
+		}
+		err = agent.Add(agents.AddedKey{
+			PrivateKey:       key,
+			Certificate:      cert,
+			Comment:          keyComment(path),
+			LifetimeSecs:     lifetimeSecs(l.Lifetime),
+			ConfirmBeforeUse: l.Confirm,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCertificate reads an OpenSSH certificate file, like id_ed25519-cert.pub.
+func readCertificate(path string) (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s", path)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.Errorf("%s is not a certificate", path)
+	}
+	return cert, nil
+}
+
+// readPublicKey returns the public key of a private key file, from its .pub
+// file if there is one. Otherwise the public key is read from the private key,
+// which works for unencrypted keys, and encrypted keys in OpenSSH's format.
+func readPublicKey(path string) (ssh.PublicKey, error) {
+	if data, err := ioutil.ReadFile(path + ".pub"); err == nil {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		return key, errors.Wrapf(err, "Parsing %s.pub", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if missing, ok := err.(*ssh.PassphraseMissingError); ok && missing.PublicKey != nil {
+		return missing.PublicKey, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read the public key of %s; create %s.pub", path, path)
+	}
+	return signer.PublicKey(), nil
+}
+
+// parse reads a private key, asking for its passphrase if it's encrypted.
+func (l *KeyFileLoader) parse(path string) (interface{}, error) {
+	return readPrivateKey(path, l.Prompter)
+}
+
+// readPrivateKey reads a private key file, asking prompter for its passphrase
+// if it's encrypted. A nil prompter uses NewPrompter.
+func readPrivateKey(path string, prompter Prompter) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return key, err
+	}
+
+	if prompter == nil {
+		if prompter, err = NewPrompter(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < passphraseAttempts; i++ {
+		passphrase, err := prompter.Prompt(fmt.Sprintf("Enter passphrase for %s", path))
+		if err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+		if err != x509.IncorrectPasswordError {
+			return key, err
+		}
+	}
+	return nil, errors.New("Too many incorrect passphrases")
+}
+
+// keyComment returns the comment from the key's .pub file, like ssh-add does,
+// or the path if there is none.
+func keyComment(path string) string {
+	data, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		return path
+	}
+	_, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil || comment == "" {
+		return path
+	}
+	return comment
+}
@@ -0,0 +1,170 @@
+package rekey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"github.com/justjake/encabulator/assert"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePrompter answers prompts with its passphrases, in order.
+type fakePrompter struct {
+	passphrases []string
+	prompts     []string
+}
+
+func (f *fakePrompter) Prompt(description string) ([]byte, error) {
+	f.prompts = append(f.prompts, description)
+	if len(f.passphrases) == 0 {
+		return nil, errors.New("cancelled")
+	}
+	passphrase := f.passphrases[0]
+	f.passphrases = f.passphrases[1:]
+	return []byte(passphrase), nil
+}
+
+func writeKey(t *testing.T, path, comment, passphrase string) ssh.PublicKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(private, comment)
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(private, comment, []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublic))) + " " + comment + "\n"
+	if err := ioutil.WriteFile(path+".pub", []byte(authorized), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return sshPublic
+}
+
+func TestKeyFileLoader_LoadInto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := writeKey(t, filepath.Join(dir, "id_plain"), "plain@example", "")
+	encrypted := writeKey(t, filepath.Join(dir, "id_encrypted"), "encrypted@example", "hunter2")
+	writeKey(t, filepath.Join(dir, "id_ecdsa_sk"), "skipped@example", "")
+
+	prompter := &fakePrompter{passphrases: []string{"wrong", "hunter2"}}
+	keyring := agents.NewKeyring()
+	loader := &KeyFileLoader{Paths: []string{filepath.Join(dir, "id_*")}, Prompter: prompter}
+	assert.Equal(t, loader.LoadInto(keyring), nil)
+	assert.Equal(t, len(prompter.prompts), 2)
+
+	keys, err := keyring.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 2)
+	comments := map[string]string{}
+	for _, key := range keys {
+		comments[Fingerprint(key)] = key.Comment
+	}
+	assert.Equal(t, comments[Fingerprint(plain)], "plain@example")
+	assert.Equal(t, comments[Fingerprint(encrypted)], "encrypted@example")
+}
+
+func TestKeyFileLoader_Cancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKey(t, filepath.Join(dir, "id_encrypted"), "encrypted@example", "hunter2")
+	keyring := agents.NewKeyring()
+	loader := &KeyFileLoader{Paths: []string{filepath.Join(dir, "id_*")}, Prompter: &fakePrompter{}}
+	assert.Equal(t, loader.LoadInto(keyring) != nil, true)
+
+	loader.Paths = []string{filepath.Join(dir, "nothing_*")}
+	assert.Equal(t, loader.LoadInto(keyring) != nil, true)
+}
+
+func TestKeyFileLoader_StrayFilesAndCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public := writeKey(t, filepath.Join(dir, "id_work"), "work@example", "")
+	for _, stray := range []string{"id_rsa.old", "id_work.ppk"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, stray), []byte("PuTTY-User-Key-File-2: ssh-rsa\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ssh-add also loads id_work-cert.pub.
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{Key: public, CertType: ssh.UserCert, KeyId: "work", ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_work-cert.pub"), ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := agents.NewKeyring()
+	loader := &KeyFileLoader{Paths: []string{filepath.Join(dir, "id_*")}, Lifetime: Forever}
+	assert.Equal(t, loader.LoadInto(keyring), nil)
+	keys, err := keyring.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 2)
+	assert.Equal(t, Certificate(keys[0]) != nil || Certificate(keys[1]) != nil, true)
+}
+
+func TestDefaultIdentityFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeKey(t, filepath.Join(dir, "id_rsa"), "me@example", "")
+	// a backup is still a private key, but isn't a default identity.
+	writeKey(t, filepath.Join(dir, "id_rsa.old"), "old@example", "")
+	writeKey(t, filepath.Join(dir, "id_work"), "work@example", "")
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_ed25519_sk"), []byte("handle"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{}
+	for _, file := range DefaultKeyFiles {
+		files = append(files, filepath.Join(dir, filepath.Base(file)))
+	}
+	paths, securityKeys, err := defaultIdentityFiles(files)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, paths, []string{filepath.Join(dir, "id_rsa")})
+	assert.Equal(t, securityKeys, []string{filepath.Join(dir, "id_ed25519_sk")})
+}
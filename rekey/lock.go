@@ -0,0 +1,101 @@
+package rekey
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultLockTimeout is how long a FileLock waits by default. Another rekey
+// holding the lock may be waiting for a PIN or a touch, so it is generous.
+const DefaultLockTimeout = 2 * time.Minute
+
+// lockPollInterval is how often a FileLock tries to take the lock.
+const lockPollInterval = 50 * time.Millisecond
+
+// FileLock is a lock shared between processes with flock(2). KeyEnsurers and
+// Groups hold it while they load keys, so that when several rekeys find the
+// same key missing, only one of them loads it and asks for the PIN. The others
+// wait, and probe again once it is done.
+type FileLock struct {
+	Path string
+	// Timeout is how long Lock waits for another process to release the lock.
+	// Zero means DefaultLockTimeout.
+	Timeout time.Duration
+
+	file *os.File
+}
+
+// LockTimeoutError is returned by FileLock.Lock when another process holds the
+// lock for longer than the timeout.
+type LockTimeoutError struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("Timed out after %v waiting for another rekey to finish loading keys (lock %s)", e.Timeout, e.Path)
+}
+
+// DefaultLockPath returns the path of the lock file used by the encabulator
+// command. It lives next to the state file.
+func DefaultLockPath() string {
+	return filepath.Join(filepath.Dir(DefaultStatePath()), "rekey.lock")
+}
+
+// NewFileLock returns a FileLock on the file at path, which is created if it
+// doesn't exist.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{Path: path}
+}
+
+// Lock takes the lock, waiting up to Timeout for other processes to release
+// it.
+func (l *FileLock) Lock() error {
+	if l.file != nil {
+		return errors.Errorf("Lock %s is already held", l.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0700); err != nil {
+		return errors.Wrap(err, "Creating lock directory")
+	}
+	file, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Opening lock")
+	}
+
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			l.file = file
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			file.Close()
+			return errors.Wrapf(err, "Locking %s", l.Path)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return &LockTimeoutError{Path: l.Path, Timeout: timeout}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	// closing the file releases the lock.
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
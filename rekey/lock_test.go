@@ -0,0 +1,61 @@
+package rekey
+
+import (
+	"context"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nested", "rekey.lock")
+
+	held := NewFileLock(path)
+	assert.Equal(t, held.Lock(), nil)
+
+	waiter := &FileLock{Path: path, Timeout: 100 * time.Millisecond}
+	_, timedOut := waiter.Lock().(*LockTimeoutError)
+	assert.Equal(t, timedOut, true)
+
+	assert.Equal(t, held.Unlock(), nil)
+	assert.Equal(t, waiter.Lock(), nil)
+	assert.Equal(t, waiter.Unlock(), nil)
+}
+
+func TestKeyEnsurer_LockWaiterProbesAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rekey.lock")
+
+	agent := rekeytest.NewAgent()
+	agent.AddPending(rekeytest.GenerateKey("fake"))
+	svc := fakeEnsurer(agent)
+	svc.Lock = NewFileLock(path)
+
+	// another rekey holds the lock while we find the key missing.
+	other := NewFileLock(path)
+	assert.Equal(t, other.Lock(), nil)
+	done := make(chan error)
+	go func() {
+		done <- svc.ensure(context.Background(), &KeyMissingError{"fake"})
+	}()
+
+	// ...and loads it.
+	assert.Equal(t, agent.Load(), nil)
+	assert.Equal(t, other.Unlock(), nil)
+
+	assert.Equal(t, <-done, nil)
+	assert.Equal(t, agent.Loads, 1)
+}
@@ -0,0 +1,95 @@
+package rekey
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ModuleSearchPath lists the directories FindModule searches for PKCS#11
+// modules, in order. The defaults cover the usual install locations on macOS
+// and on Debian, Fedora, and Arch style Linux systems.
+var ModuleSearchPath = DefaultModuleSearchPath()
+
+// KnownModules are the PKCS#11 modules used by the built-in key types, plus
+// p11-kit's proxy module, which can load any module registered with p11-kit.
+var KnownModules = []string{"libykcs11", "opensc-pkcs11", "p11-kit-proxy"}
+
+// DefaultModuleSearchPath returns the default ModuleSearchPath for this
+// platform.
+func DefaultModuleSearchPath() []string {
+	if runtime.GOOS == "darwin" {
+		return []string{
+			"/usr/local/lib",
+			"/opt/homebrew/lib",
+			"/Library/OpenSC/lib",
+			"/usr/local/lib/pkcs11",
+			"/usr/lib",
+		}
+	}
+
+	dirs := []string{}
+	if triplet, ok := multiarchTriplets[runtime.GOARCH]; ok {
+		dirs = append(dirs,
+			"/usr/lib/"+triplet,
+			"/usr/lib/"+triplet+"/pkcs11",
+		)
+	}
+	return append(dirs,
+		"/usr/lib64",
+		"/usr/lib64/pkcs11",
+		"/usr/lib",
+		"/usr/lib/pkcs11",
+		"/usr/local/lib",
+		"/usr/local/lib/pkcs11",
+	)
+}
+
+// multiarchTriplets maps GOARCH to Debian's multiarch library directory names.
+var multiarchTriplets = map[string]string{
+	"amd64": "x86_64-linux-gnu",
+	"386":   "i386-linux-gnu",
+	"arm64": "aarch64-linux-gnu",
+	"arm":   "arm-linux-gnueabihf",
+}
+
+// ModuleNotFoundError is returned by FindModule when a module isn't in any of
+// the searched directories.
+type ModuleNotFoundError struct {
+	Name     string
+	Searched []string
+}
+
+func (e *ModuleNotFoundError) Error() string {
+	return fmt.Sprintf("PKCS#11 module %s not found in %s", e.Name, strings.Join(e.Searched, ":"))
+}
+
+// FindModule resolves a PKCS#11 module by name, like "libykcs11" or
+// "opensc-pkcs11.so", by searching ModuleSearchPath. If the library extension
+// is left off, both .so and .dylib are tried. A name containing a slash is a
+// path, and is returned as-is if it exists.
+func FindModule(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		path := ExpandHome(name)
+		if _, err := os.Stat(path); err != nil {
+			return "", &ModuleNotFoundError{Name: name, Searched: []string{filepath.Dir(path)}}
+		}
+		return path, nil
+	}
+
+	candidates := []string{name}
+	if filepath.Ext(name) != ".so" && filepath.Ext(name) != ".dylib" {
+		candidates = []string{name + ".so", name + ".dylib"}
+	}
+	for _, dir := range ModuleSearchPath {
+		for _, candidate := range candidates {
+			path := filepath.Join(ExpandHome(dir), candidate)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", &ModuleNotFoundError{Name: name, Searched: ModuleSearchPath}
+}
@@ -0,0 +1,41 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path []string) { ModuleSearchPath = path }(ModuleSearchPath)
+
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	os.Mkdir(first, 0755)
+	os.Mkdir(second, 0755)
+	writeScript(t, second, "libykcs11.so", "")
+	writeScript(t, second, "opensc-pkcs11.dylib", "")
+	ModuleSearchPath = []string{first, second}
+
+	path, err := FindModule("libykcs11")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, path, filepath.Join(second, "libykcs11.so"))
+
+	path, err = FindModule("opensc-pkcs11")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, path, filepath.Join(second, "opensc-pkcs11.dylib"))
+
+	path, err = FindModule(filepath.Join(second, "libykcs11.so"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, path, filepath.Join(second, "libykcs11.so"))
+
+	_, err = FindModule("libykcs11.dylib")
+	_, ok := err.(*ModuleNotFoundError)
+	assert.Equal(t, ok, true)
+}
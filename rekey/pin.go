@@ -0,0 +1,188 @@
+package rekey
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/exec"
+)
+
+const (
+	// askpassEnv is set when we run ourselves as SSH_ASKPASS for ssh-add. It
+	// holds the pinentry program to ask for the PIN.
+	askpassEnv = "ENCABULATOR_ASKPASS_PINENTRY"
+	// SSHAskpass names the environment variable that holds the askpass
+	// program used by OpenSSH.
+	SSHAskpass = "SSH_ASKPASS"
+)
+
+// PinentryProgram is the pinentry program used to ask for PINs when there is
+// no TTY and SSH_ASKPASS is unset.
+var PinentryProgram = "pinentry"
+
+// ErrNoPrompter is returned when there is no way to ask the user for a PIN.
+var ErrNoPrompter = errors.New("No TTY to ask for a PIN: set SSH_ASKPASS, or install pinentry")
+
+// Prompter asks the user for a secret, such as a PIN or passphrase.
+type Prompter interface {
+	Prompt(description string) ([]byte, error)
+}
+
+// Pinentry asks for secrets using a pinentry program, speaking the Assuan
+// protocol.
+type Pinentry struct {
+	Program string
+}
+
+// Prompt runs pinentry, and returns the entered secret.
+func (p *Pinentry) Prompt(description string) ([]byte, error) {
+	cmd := exec.Command(p.Program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "Starting %s", p.Program)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	conn := newAssuanConn(stdout, stdin)
+	// greeting
+	if _, err := conn.ReadResponse(); err != nil {
+		return nil, err
+	}
+	commands := []string{
+		"SETTITLE encabulator",
+		"SETDESC " + assuanEscape(description),
+		"SETPROMPT PIN:",
+	}
+	for _, command := range commands {
+		if _, err := conn.Transact(command); err != nil {
+			return nil, errors.Wrap(err, command)
+		}
+	}
+
+	pin, err := conn.Transact("GETPIN")
+	if err != nil {
+		return nil, err
+	}
+	conn.Transact("BYE")
+	return pin, nil
+}
+
+// Askpass asks for secrets using an ssh-askpass program, which prints the
+// secret to stdout.
+type Askpass struct {
+	Program string
+}
+
+// Prompt runs the askpass program, and returns the entered secret.
+func (a *Askpass) Prompt(description string) ([]byte, error) {
+	cmd := exec.Command(a.Program, description)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Running %s", a.Program)
+	}
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// FindPrompter returns the program that should ask for PINs when there is no
+// TTY: SSH_ASKPASS if set, otherwise PinentryProgram if installed.
+func FindPrompter() (Prompter, error) {
+	if askpass := os.Getenv(SSHAskpass); askpass != "" {
+		return &Askpass{askpass}, nil
+	}
+	if path, err := exec.LookPath(PinentryProgram); err == nil {
+		return &Pinentry{path}, nil
+	}
+	return nil, ErrNoPrompter
+}
+
+// Terminal asks for secrets on the controlling terminal, without echoing
+// them.
+type Terminal struct{}
+
+// Prompt prints the description to stderr, and reads a secret from stdin.
+func (Terminal) Prompt(description string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", description)
+	secret, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return secret, err
+}
+
+// NewPrompter returns a Prompter that asks on the terminal if there is one,
+// and otherwise uses FindPrompter. This is how ssh-add prompts when run by
+// rekey.
+func NewPrompter() (Prompter, error) {
+	if hasTTY() {
+		return Terminal{}, nil
+	}
+	return FindPrompter()
+}
+
+func hasTTY() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// useAskpass configures a command that may prompt with ssh's askpass
+// mechanism, such as ssh-add, to ask for PINs with FindPrompter when we have
+// no TTY. Pinentry is wired up by running ourselves as SSH_ASKPASS; see
+// RunAskpass.
+func useAskpass(cmd *exec.Cmd) error {
+	if hasTTY() {
+		return nil
+	}
+	prompter, err := FindPrompter()
+	if err != nil {
+		return err
+	}
+
+	env := append(os.Environ(), "SSH_ASKPASS_REQUIRE=force")
+	if os.Getenv("DISPLAY") == "" {
+		// older versions of ssh only use askpass if DISPLAY is set.
+		env = append(env, "DISPLAY=:0")
+	}
+	if pinentry, ok := prompter.(*Pinentry); ok {
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		env = append(env, SSHAskpass+"="+self, askpassEnv+"="+pinentry.Program)
+	}
+	cmd.Env = env
+	return nil
+}
+
+// IsAskpass returns true if this process was started as SSH_ASKPASS by
+// useAskpass. Programs that load keys should check this first thing in main,
+// and call RunAskpass.
+func IsAskpass() bool {
+	return os.Getenv(askpassEnv) != ""
+}
+
+// RunAskpass implements the ssh-askpass protocol using pinentry: it asks for
+// the secret described by args, prints it to stdout, and returns an exit
+// code.
+func RunAskpass(args []string) int {
+	description := "Enter PIN"
+	if len(args) > 0 {
+		description = args[0]
+	}
+
+	pinentry := &Pinentry{os.Getenv(askpassEnv)}
+	pin, err := pinentry.Prompt(description)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", pin)
+	return 0
+}
@@ -0,0 +1,100 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakePinentry answers GETPIN with "12%34", or cancels if PINENTRY_CANCEL is
+// set.
+const fakePinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r cmd rest; do
+	case "$cmd" in
+	GETPIN)
+		if [ -n "$PINENTRY_CANCEL" ]; then
+			echo "ERR 83886179 Operation cancelled <Pinentry>"
+		else
+			echo "# a comment"
+			echo "D 12%2534"
+			echo "OK"
+		fi
+		;;
+	BYE)
+		echo "OK closing connection"
+		exit 0
+		;;
+	*)
+		echo "OK"
+		;;
+	esac
+done
+`
+
+const fakeAskpass = `#!/bin/sh
+echo "pin for $1"
+`
+
+func writeScript(t *testing.T, dir, name, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPinentry_Prompt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pinentry := &Pinentry{writeScript(t, dir, "pinentry", fakePinentry)}
+	pin, err := pinentry.Prompt("Enter the PIN for your token\nplease")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(pin), "12%34")
+
+	os.Setenv("PINENTRY_CANCEL", "1")
+	defer os.Unsetenv("PINENTRY_CANCEL")
+	_, err = pinentry.Prompt("Enter PIN")
+	assuanErr, ok := err.(*AssuanError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, assuanErr.Cancelled(), true)
+}
+
+func TestAskpass_Prompt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-pin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	askpass := &Askpass{writeScript(t, dir, "askpass", fakeAskpass)}
+	pin, err := askpass.Prompt("yubikey")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(pin), "pin for yubikey")
+}
+
+func TestFindPrompter(t *testing.T) {
+	defer os.Setenv(SSHAskpass, os.Getenv(SSHAskpass))
+	defer func(program string) { PinentryProgram = program }(PinentryProgram)
+
+	os.Setenv(SSHAskpass, "/usr/bin/my-askpass")
+	prompter, err := FindPrompter()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, prompter, Prompter(&Askpass{"/usr/bin/my-askpass"}))
+
+	os.Setenv(SSHAskpass, "")
+	PinentryProgram = "no-such-pinentry"
+	_, err = FindPrompter()
+	assert.Equal(t, err, ErrNoPrompter)
+}
+
+func TestAssuanUnescape(t *testing.T) {
+	assert.Equal(t, assuanUnescape("a%0Ab%25c%"), "a\nb%c%")
+	assert.Equal(t, assuanUnescape(assuanEscape("100%\r\n")), "100%\r\n")
+}
@@ -0,0 +1,132 @@
+package rekey
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// Predicate selects keys held by ssh-agent. Predicates can be combined with
+// And, Or, and Not to describe keys precisely.
+type Predicate func(key *agents.Key) bool
+
+// Any matches every key.
+func Any(_ *agents.Key) bool {
+	return true
+}
+
+// Fingerprint returns the SHA256 fingerprint of a key, in the same format as
+// `ssh-add -l`.
+func Fingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// normalizeFingerprint accepts fingerprints with or without the "SHA256:"
+// prefix and base64 padding.
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	fp = strings.TrimPrefix(fp, "SHA256:")
+	return "SHA256:" + strings.TrimRight(fp, "=")
+}
+
+// ByFingerprint matches keys whose SHA256 fingerprint is one of the given
+// fingerprints.
+func ByFingerprint(fingerprints ...string) Predicate {
+	set := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		set[normalizeFingerprint(fp)] = true
+	}
+	return func(key *agents.Key) bool {
+		return set[Fingerprint(key)]
+	}
+}
+
+// ByType matches keys whose algorithm is one of the given types, eg
+// "ssh-ed25519".
+func ByType(types ...string) Predicate {
+	return func(key *agents.Key) bool {
+		for _, t := range types {
+			if key.Type() == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByComment matches keys whose comment matches the given regexp.
+func ByComment(re *regexp.Regexp) Predicate {
+	return func(key *agents.Key) bool {
+		return re.MatchString(key.Comment)
+	}
+}
+
+// And matches keys that match all of the given predicates.
+func And(predicates ...Predicate) Predicate {
+	return func(key *agents.Key) bool {
+		for _, p := range predicates {
+			if !p(key) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or matches keys that match any of the given predicates.
+func Or(predicates ...Predicate) Predicate {
+	return func(key *agents.Key) bool {
+		for _, p := range predicates {
+			if p(key) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not matches keys that don't match the given predicate.
+func Not(predicate Predicate) Predicate {
+	return func(key *agents.Key) bool {
+		return !predicate(key)
+	}
+}
+
+// ReadFingerprints returns the fingerprints of every public key in an
+// authorized_keys-style file. Blank lines and comments are skipped.
+func ReadFingerprints(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		fingerprints = append(fingerprints, Fingerprint(key))
+	}
+	return fingerprints, scanner.Err()
+}
+
+// ByAuthorizedKeys matches keys listed in an authorized_keys-style file, such
+// as a .pub file or a list of pinned keys.
+func ByAuthorizedKeys(path string) (Predicate, error) {
+	fingerprints, err := ReadFingerprints(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading authorized keys")
+	}
+	return ByFingerprint(fingerprints...), nil
+}
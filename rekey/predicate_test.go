@@ -0,0 +1,89 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// listed returns key as ssh-agent would list it.
+func listed(key agents.AddedKey) *agents.Key {
+	public := rekeytest.PublicKey(key)
+	return &agents.Key{Format: public.Type(), Blob: public.Marshal(), Comment: key.Comment}
+}
+
+func TestPredicates(t *testing.T) {
+	work := listed(rekeytest.GenerateKey("work@example"))
+	home := listed(rekeytest.GenerateKey("home@example"))
+	fp := Fingerprint(work)
+
+	assert.Equal(t, ByFingerprint(fp)(work), true)
+	assert.Equal(t, ByFingerprint(fp)(home), false)
+	// the prefix and base64 padding are optional.
+	assert.Equal(t, ByFingerprint(strings.TrimPrefix(fp, "SHA256:")+"=")(work), true)
+
+	assert.Equal(t, ByType(ssh.KeyAlgoED25519)(work), true)
+	assert.Equal(t, ByType(ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256)(work), false)
+
+	byComment := ByComment(regexp.MustCompile("^work@"))
+	assert.Equal(t, byComment(work), true)
+	assert.Equal(t, byComment(home), false)
+
+	assert.Equal(t, And(byComment, ByType(ssh.KeyAlgoED25519))(work), true)
+	assert.Equal(t, And(byComment, ByType(ssh.KeyAlgoRSA))(work), false)
+	assert.Equal(t, And()(work), true)
+	assert.Equal(t, Or(byComment, ByFingerprint(Fingerprint(home)))(home), true)
+	assert.Equal(t, Or(byComment)(home), false)
+	assert.Equal(t, Or()(work), false)
+	assert.Equal(t, Not(byComment)(home), true)
+	assert.Equal(t, Not(byComment)(work), false)
+}
+
+func TestByAuthorizedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-predicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	work := rekeytest.GenerateKey("work@example")
+	authorized := "# pinned keys\n\n" + string(ssh.MarshalAuthorizedKey(rekeytest.PublicKey(work)))
+	path := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(path, []byte(authorized), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	byFile, err := ByAuthorizedKeys(path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, byFile(listed(work)), true)
+	assert.Equal(t, byFile(listed(rekeytest.GenerateKey("other"))), false)
+
+	if err := ioutil.WriteFile(path, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ByAuthorizedKeys(path)
+	assert.Equal(t, err != nil, true)
+}
+
+func TestMatchRule_Fingerprint(t *testing.T) {
+	work := listed(rekeytest.GenerateKey("work@example"))
+	home := listed(rekeytest.GenerateKey("home@example"))
+
+	// profiles written before fingerprints was a list still pin their key.
+	predicate, err := MatchRule{Fingerprint: Fingerprint(work)}.Predicate()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, predicate(work), true)
+	assert.Equal(t, predicate(home), false)
+
+	predicate, err = MatchRule{Fingerprint: Fingerprint(work), Fingerprints: []string{Fingerprint(home)}}.Predicate()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, predicate(work), true)
+	assert.Equal(t, predicate(home), true)
+}
@@ -0,0 +1,210 @@
+package rekey
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"time"
+)
+
+// DefaultProbeTimeout bounds how long a probe waits for the agent, including
+// the time a token spends waiting for a touch.
+const DefaultProbeTimeout = 15 * time.Second
+
+// The probe signs this many random bytes.
+const challengeSize = 32
+
+// AgentUnreachableError means that ssh-agent could not be reached, or did not
+// answer in time.
+type AgentUnreachableError struct {
+	Err error
+}
+
+func (e *AgentUnreachableError) Error() string {
+	return fmt.Sprintf("ssh-agent unreachable: %v", e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *AgentUnreachableError) Cause() error {
+	return e.Err
+}
+
+// KeyMissingError means that no key in the agent matched the predicate.
+type KeyMissingError struct {
+	Name string
+}
+
+func (e *KeyMissingError) Error() string {
+	return fmt.Sprintf("%s not found in ssh-agent", e.Name)
+}
+
+// SignRefusedError means that the agent refused to sign with the key, or did
+// not sign in time.
+type SignRefusedError struct {
+	Key *agents.Key
+	Err error
+}
+
+func (e *SignRefusedError) Error() string {
+	return fmt.Sprintf("ssh-agent refused to sign with %s: %v", Fingerprint(e.Key), e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *SignRefusedError) Cause() error {
+	return e.Err
+}
+
+// SignatureInvalidError means that the agent returned a signature that does
+// not verify with the key's public key.
+type SignatureInvalidError struct {
+	Key *agents.Key
+	Err error
+}
+
+func (e *SignatureInvalidError) Error() string {
+	return fmt.Sprintf("ssh-agent returned an invalid signature for %s: %v", Fingerprint(e.Key), e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *SignatureInvalidError) Cause() error {
+	return e.Err
+}
+
+// IsUnreachable returns true if err was caused by an AgentUnreachableError.
+func IsUnreachable(err error) bool {
+	// errors.Cause would look past the AgentUnreachableError, to its cause.
+	for err != nil {
+		if _, ok := err.(*AgentUnreachableError); ok {
+			return true
+		}
+		causer, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+// Probe checks that a key matching the predicate is loaded and usable: the
+// agent must sign a random challenge with the key, and the signature must
+// verify with the key's public key. Returns nil if the key is usable, or one
+// of AgentUnreachableError, KeyMissingError, SignRefusedError, or
+// SignatureInvalidError.
+//
+// The probe gives up after ProbeTimeout, or when ctx is done.
+func (svc *KeyEnsurer) Probe(ctx context.Context) error {
+	timeout := svc.ProbeTimeout
+	if timeout == 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := svc.connect(); err != nil {
+		return &AgentUnreachableError{err}
+	}
+
+	agent := svc.agent
+	var key *agents.Key
+	err := withContext(ctx, svc.disconnect, func() (err error) {
+		key, err = FindKey(agent, svc.KeyPredicate)
+		return err
+	})
+	if err != nil {
+		svc.disconnect()
+		return &AgentUnreachableError{err}
+	}
+	if key == nil {
+		return &KeyMissingError{svc.String()}
+	}
+	if IsSecurityKey(key) && !svc.VerifyPresence {
+		return nil
+	}
+	if svc.probeCached(key) {
+		return nil
+	}
+
+	err = probeSign(ctx, agent, key, svc.disconnect)
+	svc.cacheProbe(key, err)
+	return err
+}
+
+// probeCached returns true if key signed a probe within ProbeCacheTTL.
+func (svc *KeyEnsurer) probeCached(key *agents.Key) bool {
+	if svc.ProbeCacheTTL <= 0 || svc.State == nil {
+		return false
+	}
+	since := svc.now().Add(-svc.ProbeCacheTTL)
+	return svc.State.VerifiedSince(svc.String(), ssh.FingerprintSHA256(key), since)
+}
+
+// cacheProbe records the outcome of signing a probe with key. Probes are
+// saved apart from the load records, which need the FileLock to change, and
+// reloaded first to keep the probes of other processes. Failing to save only
+// costs a sign on the next probe, so errors are ignored.
+func (svc *KeyEnsurer) cacheProbe(key *agents.Key, probed error) {
+	if svc.ProbeCacheTTL <= 0 || svc.State == nil {
+		return
+	}
+	if err := svc.State.ReloadProbes(); err != nil {
+		return
+	}
+	if probed == nil {
+		svc.State.Verified(svc.String(), ssh.FingerprintSHA256(key), svc.now())
+	} else {
+		svc.State.Unverified(svc.String())
+	}
+	svc.State.SaveProbes()
+}
+
+// probeSign has the agent sign a random challenge with key, and verifies the
+// signature. If ctx finishes first, abort is called to unblock the agent.
+func probeSign(ctx context.Context, agent agents.Agent, key *agents.Key, abort func()) error {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	err := withContext(ctx, abort, func() error {
+		sig, err := agent.Sign(key, challenge)
+		if err != nil {
+			return &SignRefusedError{key, err}
+		}
+		if err := key.Verify(challenge, sig); err != nil {
+			return &SignatureInvalidError{key, err}
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	if _, refused := err.(*SignRefusedError); (refused || err == ctx.Err()) && IsSecurityKey(key) {
+		return &PresenceRequiredError{key, err}
+	}
+	if err == ctx.Err() {
+		// the agent is still waiting, probably for a touch.
+		return &SignRefusedError{key, err}
+	}
+	return err
+}
+
+// withContext runs fn, which talks to the agent, until ctx is done. If ctx
+// finishes first, abort is called to unblock fn, and ctx's error is returned.
+func withContext(ctx context.Context, abort func(), fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		abort()
+		return ctx.Err()
+	}
+}
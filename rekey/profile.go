@@ -0,0 +1,310 @@
+package rekey
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Profile describes a key that should be loaded into ssh-agent, and how to
+// load it if it's missing. Profiles are usually declared in the config file:
+//
+//	rekey:
+//	  profiles:
+//	    work:
+//	      match:
+//	        comment: libykcs11
+//	        type: ecdsa-sha2-nistp256
+//	      load:
+//	        pkcs11: libykcs11
+//	      lifetime: 4h
+type Profile struct {
+	// Name of the profile, as passed to `rekey --type`.
+	Name string
+	// Match describes which agent keys satisfy this profile.
+	Match MatchRule
+	// Load describes how to add the key to the agent.
+	Load LoadRule
+	// Certificate, if set, requires the key to be loaded with a valid
+	// certificate. If it has a CA, certificates are issued with it instead of
+	// using Load.
+	Certificate CertRule
+	// Lifetime is how long the agent should keep the key. Zero uses
+	// DefaultLifetime. Command loaders should use the same lifetime, so that
+	// rekey knows when the key expires.
+	Lifetime time.Duration
+	// VerifyPresence signs probes with FIDO security keys, which needs a
+	// touch; see KeyEnsurer.VerifyPresence.
+	VerifyPresence bool
+}
+
+// MatchRule selects keys in the agent. Every non-empty field must match. A
+// rule with no fields set matches any key.
+type MatchRule struct {
+	// Comment is a regexp matched against the key's comment.
+	Comment string
+	// Fingerprints pins the key to one of these SHA256 fingerprints, as
+	// printed by `ssh-add -l`, eg "SHA256:jk2...".
+	Fingerprints []string
+	// Fingerprint pins the key to a single fingerprint. It predates
+	// Fingerprints, and is added to them.
+	Fingerprint string
+	// AuthorizedKeys pins the key to one of the keys in this
+	// authorized_keys-style file, such as the key's .pub file.
+	AuthorizedKeys string
+	// Type is the key's algorithm, eg "ssh-ed25519".
+	Type string
+	// SecurityKey matches keys on FIDO security keys, of any of the
+	// SecurityKeyTypes.
+	SecurityKey bool
+	// All matches every key. It has no effect on its own, but says that a rule
+	// is meant to match everything where an empty rule is refused, as in
+	// FilterPolicy.
+	All bool
+}
+
+// Empty returns true if no fields of the rule are set.
+func (m MatchRule) Empty() bool {
+	return m.Comment == "" && len(m.Fingerprints) == 0 && m.Fingerprint == "" && m.AuthorizedKeys == "" &&
+		m.Type == "" && !m.SecurityKey && !m.All
+}
+
+// LoadRule describes how to load a key into ssh-agent. Exactly one field
+// should be set.
+type LoadRule struct {
+	// PKCS11 is the path or name of a PKCS#11 module to load with
+	// `ssh-add -s`. Names are resolved with FindModule.
+	PKCS11 string
+	// File is the path to a private key file to load with `ssh-add`.
+	File string
+	// Keys lists private key files, or globs, to load without ssh-add; see
+	// KeyFileLoader.
+	Keys []string
+	// Confirm asks the agent to confirm each use of the keys loaded from Keys.
+	Confirm bool
+	// GPGAgent loads the key on an OpenPGP card with gpg-agent; see GPGAgent.
+	GPGAgent bool
+	// Resident loads the resident keys of FIDO security keys with
+	// `ssh-add -K`. Use File for security keys with a key file.
+	Resident bool
+	// Command is a custom command that loads the key.
+	Command []string
+}
+
+// Predicate returns a Predicate that matches keys described by this rule.
+func (m MatchRule) Predicate() (Predicate, error) {
+	predicates := []Predicate{Any}
+	if m.Comment != "" {
+		re, err := regexp.Compile(m.Comment)
+		if err != nil {
+			return nil, errors.Wrap(err, "Parsing comment regexp")
+		}
+		predicates = append(predicates, ByComment(re))
+	}
+	fingerprints := m.Fingerprints
+	if m.Fingerprint != "" {
+		fingerprints = append(append([]string{}, fingerprints...), m.Fingerprint)
+	}
+	if len(fingerprints) > 0 {
+		predicates = append(predicates, ByFingerprint(fingerprints...))
+	}
+	if m.AuthorizedKeys != "" {
+		byFile, err := ByAuthorizedKeys(ExpandHome(m.AuthorizedKeys))
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, byFile)
+	}
+	if m.Type != "" {
+		predicates = append(predicates, ByType(m.Type))
+	}
+	if m.SecurityKey {
+		predicates = append(predicates, IsSecurityKey)
+	}
+	return And(predicates...), nil
+}
+
+// Loader returns a function that loads the key described by this rule, adding
+// it to the agent with the given lifetime.
+func (l LoadRule) Loader(lifetime time.Duration) (func() error, error) {
+	return l.loader(lifetime, &KeyEnsurer{})
+}
+
+// loader is like Loader, but runs commands and dials the agent with svc.
+func (l LoadRule) loader(lifetime time.Duration, svc *KeyEnsurer) (func() error, error) {
+	switch {
+	case l.PKCS11 != "":
+		return moduleLoader(l.PKCS11, lifetime, svc.run), nil
+	case l.File != "":
+		return fileLoader(ExpandHome(l.File), lifetime, svc.run), nil
+	case len(l.Keys) > 0:
+		loader := &KeyFileLoader{Paths: l.Keys, Lifetime: lifetime, Confirm: l.Confirm, Dial: svc.dial}
+		return loader.Load, nil
+	case l.GPGAgent:
+		return (&GPGAgent{}).Load, nil
+	case l.Resident:
+		return residentLoader(lifetime, svc.run), nil
+	case len(l.Command) > 0:
+		return commandLoader(svc.run, l.Command...), nil
+	}
+	return nil, errors.New("No loader configured: set one of pkcs11, file, keys, gpgagent, resident, or command")
+}
+
+// Unloader returns a function that removes the key from the agent before it is
+// refreshed, or nil if loading the key again replaces it.
+func (l LoadRule) Unloader() func() error {
+	return l.unloader(&KeyEnsurer{})
+}
+
+func (l LoadRule) unloader(svc *KeyEnsurer) func() error {
+	if l.PKCS11 != "" {
+		return moduleUnloader(l.PKCS11, svc.run)
+	}
+	return nil
+}
+
+// Ensurer builds a KeyEnsurer for this profile.
+func (p *Profile) Ensurer() (*KeyEnsurer, error) {
+	predicate, err := p.Match.Predicate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Profile %s", p.Name)
+	}
+	svc := New(predicate, nil).Named(p.Name)
+	svc.Lifetime = p.Lifetime
+	svc.VerifyPresence = p.VerifyPresence
+	if p.Certificate.Enabled() {
+		svc.KeyPredicate = ByCertificate(p.Certificate, predicate, svc.now)
+	}
+
+	if p.Certificate.CA != "" {
+		if p.Certificate.Key == "" {
+			return nil, errors.Errorf("Profile %s: certificate.key is required with certificate.ca", p.Name)
+		}
+		signer := &CertSigner{
+			Key:        p.Certificate.Key,
+			CA:         p.Certificate.CA,
+			KeyID:      p.Name,
+			Principals: p.Certificate.Principals,
+			Validity:   p.Certificate.Validity,
+			Lifetime:   p.Lifetime,
+			Dial:       svc.dial,
+			Now:        svc.now,
+		}
+		svc.KeyLoader = signer.Load
+		if svc.Lifetime <= 0 || svc.Lifetime > signer.validity() {
+			svc.Lifetime = signer.validity()
+		}
+		return svc, nil
+	}
+
+	svc.KeyLoader, err = p.Load.loader(p.Lifetime, svc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Profile %s", p.Name)
+	}
+	svc.KeyUnloader = p.Load.unloader(svc)
+	return svc, nil
+}
+
+// PKCS11Loader returns a function that loads the given PKCS11 module into
+// ssh-agent using `ssh-add`.
+func PKCS11Loader(path string, lifetime time.Duration) func() error {
+	return pkcs11Loader(path, lifetime, runInteractive)
+}
+
+func pkcs11Loader(path string, lifetime time.Duration, run func(*exec.Cmd) error) func() error {
+	return func() error {
+		return run(sshAdd(append([]string{"-s", path}, lifetimeArgs(lifetime)...)...))
+	}
+}
+
+// ModuleLoader returns a function that finds the named PKCS11 module with
+// FindModule, and loads it into ssh-agent using `ssh-add`. The module is
+// looked up each time, so that it can be installed after rekey starts.
+func ModuleLoader(name string, lifetime time.Duration) func() error {
+	return moduleLoader(name, lifetime, runInteractive)
+}
+
+func moduleLoader(name string, lifetime time.Duration, run func(*exec.Cmd) error) func() error {
+	return func() error {
+		path, err := FindModule(name)
+		if err != nil {
+			return err
+		}
+		return pkcs11Loader(path, lifetime, run)()
+	}
+}
+
+// ModuleUnloader returns a function that finds the named PKCS11 module with
+// FindModule, and removes its keys from ssh-agent.
+func ModuleUnloader(name string) func() error {
+	return moduleUnloader(name, runInteractive)
+}
+
+func moduleUnloader(name string, run func(*exec.Cmd) error) func() error {
+	return func() error {
+		path, err := FindModule(name)
+		if err != nil {
+			return err
+		}
+		return run(sshAdd("-e", path))
+	}
+}
+
+// FileLoader returns a function that loads the given private key file into
+// ssh-agent using `ssh-add`.
+func FileLoader(path string, lifetime time.Duration) func() error {
+	return fileLoader(path, lifetime, runInteractive)
+}
+
+func fileLoader(path string, lifetime time.Duration, run func(*exec.Cmd) error) func() error {
+	return func() error {
+		return run(sshAdd(append(lifetimeArgs(lifetime), path)...))
+	}
+}
+
+// CommandLoader returns a function that runs the given command to load a key.
+// The command is connected to our stdio so that it can prompt the user.
+func CommandLoader(argv ...string) func() error {
+	return commandLoader(runInteractive, argv...)
+}
+
+func commandLoader(run func(*exec.Cmd) error, argv ...string) func() error {
+	return func() error {
+		return run(exec.Command(argv[0], argv[1:]...))
+	}
+}
+
+func sshAdd(args ...string) *exec.Cmd {
+	return exec.Command("ssh-add", args...)
+}
+
+func runInteractive(cmd *exec.Cmd) error {
+	// pass along IO so users can type into the loader
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// without a TTY, prompt for PINs through askpass or pinentry. Keys that
+	// don't need a PIN can still load without either.
+	promptErr := useAskpass(cmd)
+	err := cmd.Run()
+	if err != nil && promptErr != nil {
+		return errors.Wrap(err, promptErr.Error())
+	}
+	return err
+}
+
+// lifetimeArgs returns the `ssh-add -t` option for a lifetime, or none for
+// Forever, so that the agent keeps the key as long as State says it does.
+func lifetimeArgs(lifetime time.Duration) []string {
+	if lifetime == Forever {
+		return nil
+	}
+	if lifetime <= 0 {
+		lifetime = DefaultLifetime
+	}
+	return []string{"-t", strconv.Itoa(int(lifetime / time.Second))}
+}
@@ -0,0 +1,243 @@
+package rekey
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Proxy is an agent that forwards every request to another agent, usually the
+// one behind SSH_AUTH_SOCK. When a List or Sign request would fail because a
+// KeyEnsurer's key is missing, Proxy runs that KeyEnsurer's KeyLoader and
+// retries, so that any program using the proxy gets its keys loaded on demand.
+//
+// Serve a Proxy with keyagent.Listen.
+type Proxy struct {
+	Ensurers []*KeyEnsurer
+	// Cooldown is how long to wait after a failed load before loading the same
+	// key again. Clients like IDEs list keys often, and shouldn't trigger a PIN
+	// prompt every time.
+	Cooldown time.Duration
+	// Logf logs loads and failures. Defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+
+	dial func() (net.Conn, error)
+
+	// loading serializes loads, so that the user is prompted once.
+	loading  sync.Mutex
+	failedAt map[*KeyEnsurer]time.Time
+
+	mu   sync.Mutex
+	seen map[string]*agents.Key
+}
+
+// NewProxy returns a Proxy that forwards to the agent behind SSH_AUTH_SOCK, and
+// loads keys using the given ensurers.
+func NewProxy(ensurers ...*KeyEnsurer) *Proxy {
+	return &Proxy{
+		Ensurers: ensurers,
+		Cooldown: time.Minute,
+		Logf:     log.Printf,
+		dial:     dialAgent,
+		failedAt: make(map[*KeyEnsurer]time.Time),
+		seen:     make(map[string]*agents.Key),
+	}
+}
+
+// upstream connects to the real agent. Each request uses its own connection,
+// so that concurrent clients don't share state.
+func (p *Proxy) upstream() (agents.ExtendedAgent, func(), error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, nil, &AgentUnreachableError{err}
+	}
+	return agents.NewClient(conn), func() { conn.Close() }, nil
+}
+
+// List returns the identities known to the agent, loading any missing keys
+// first.
+func (p *Proxy) List() ([]*agents.Key, error) {
+	keys, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := false
+	for _, svc := range p.Ensurers {
+		if !anyMatch(keys, svc.KeyPredicate) && p.load(svc) {
+			loaded = true
+		}
+	}
+	if loaded {
+		return p.list()
+	}
+	return keys, nil
+}
+
+func (p *Proxy) list() ([]*agents.Key, error) {
+	upstream, done, err := p.upstream()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	keys, err := upstream.List()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	for _, key := range keys {
+		p.seen[string(key.Blob)] = key
+	}
+	p.mu.Unlock()
+	return keys, nil
+}
+
+func anyMatch(keys []*agents.Key, predicate Predicate) bool {
+	for _, key := range keys {
+		if predicate(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// load loads the key for svc, unless it failed to load recently. Returns true
+// if the key was loaded.
+func (p *Proxy) load(svc *KeyEnsurer) bool {
+	p.loading.Lock()
+	defer p.loading.Unlock()
+
+	if failed, ok := p.failedAt[svc]; ok && time.Since(failed) < p.Cooldown {
+		return false
+	}
+
+	// another request may have loaded the key while we waited for the lock.
+	err := svc.Probe(context.Background())
+	if err == nil {
+		return true
+	}
+
+	p.Logf("%s: loading", svc)
+	if err := svc.ensure(context.Background(), err); err != nil {
+		p.Logf("%s: %v", svc, err)
+		p.failedAt[svc] = time.Now()
+		return false
+	}
+	delete(p.failedAt, svc)
+	return true
+}
+
+// ensurerFor returns the KeyEnsurer responsible for key, if any.
+func (p *Proxy) ensurerFor(key ssh.PublicKey) *KeyEnsurer {
+	p.mu.Lock()
+	listed, ok := p.seen[string(key.Marshal())]
+	p.mu.Unlock()
+	if !ok {
+		listed = &agents.Key{Format: key.Type(), Blob: key.Marshal()}
+	}
+
+	for _, svc := range p.Ensurers {
+		if svc.KeyPredicate(listed) {
+			return svc
+		}
+	}
+	return nil
+}
+
+// Sign has the agent sign the data using a protocol 2 key as defined in
+// [PROTOCOL.agent] section 2.6.2.
+func (p *Proxy) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return p.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign, loading the key and retrying if signing
+// fails.
+func (p *Proxy) SignWithFlags(key ssh.PublicKey, data []byte, flags agents.SignatureFlags) (*ssh.Signature, error) {
+	sig, err := p.signWithFlags(key, data, flags)
+	if err == nil || IsUnreachable(err) || isSecurityKeyType(key.Type()) {
+		// security keys fail to sign when they aren't touched, which loading
+		// won't fix.
+		return sig, err
+	}
+
+	svc := p.ensurerFor(key)
+	if svc == nil || !p.load(svc) {
+		return nil, err
+	}
+	return p.signWithFlags(key, data, flags)
+}
+
+func (p *Proxy) signWithFlags(key ssh.PublicKey, data []byte, flags agents.SignatureFlags) (*ssh.Signature, error) {
+	upstream, done, err := p.upstream()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return upstream.SignWithFlags(key, data, flags)
+}
+
+// forward runs fn against a new connection to the real agent.
+func (p *Proxy) forward(fn func(upstream agents.ExtendedAgent) error) error {
+	upstream, done, err := p.upstream()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return fn(upstream)
+}
+
+// Add adds a private key to the agent.
+func (p *Proxy) Add(key agents.AddedKey) error {
+	return p.forward(func(upstream agents.ExtendedAgent) error {
+		return upstream.Add(key)
+	})
+}
+
+// Remove removes all identities with the given public key.
+func (p *Proxy) Remove(key ssh.PublicKey) error {
+	return p.forward(func(upstream agents.ExtendedAgent) error {
+		return upstream.Remove(key)
+	})
+}
+
+// RemoveAll removes all identities.
+func (p *Proxy) RemoveAll() error {
+	return p.forward(func(upstream agents.ExtendedAgent) error {
+		return upstream.RemoveAll()
+	})
+}
+
+// Lock locks the agent.
+func (p *Proxy) Lock(passphrase []byte) error {
+	return p.forward(func(upstream agents.ExtendedAgent) error {
+		return upstream.Lock(passphrase)
+	})
+}
+
+// Unlock undoes the effect of Lock.
+func (p *Proxy) Unlock(passphrase []byte) error {
+	return p.forward(func(upstream agents.ExtendedAgent) error {
+		return upstream.Unlock(passphrase)
+	})
+}
+
+// Signers is not supported over a proxy, just like over an agent client.
+func (p *Proxy) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("Signers are not supported by the rekey proxy")
+}
+
+// Extension forwards extension requests to the real agent.
+func (p *Proxy) Extension(extensionType string, contents []byte) (response []byte, err error) {
+	err = p.forward(func(upstream agents.ExtendedAgent) error {
+		response, err = upstream.Extension(extensionType, contents)
+		return err
+	})
+	return response, err
+}
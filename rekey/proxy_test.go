@@ -0,0 +1,98 @@
+package rekey
+
+import (
+	"errors"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"testing"
+	"time"
+)
+
+// fakeProxy returns a Proxy in front of agent, that logs nothing.
+func fakeProxy(agent *rekeytest.Agent, ensurers ...*KeyEnsurer) *Proxy {
+	proxy := NewProxy(ensurers...)
+	proxy.dial = agent.Dial
+	proxy.Logf = func(format string, args ...interface{}) {}
+	return proxy
+}
+
+func TestProxy_LoadsOnList(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	proxy := fakeProxy(agent, fakeEnsurer(agent))
+
+	agent.AddPending(rekeytest.GenerateKey("fake"))
+	keys, err := proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, agent.Loads, 1)
+
+	// already loaded.
+	keys, err = proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, agent.Loads, 1)
+}
+
+func TestProxy_LoadsOnSign(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	key := rekeytest.GenerateKey("fake")
+	agent.Add(key)
+	proxy := fakeProxy(agent, fakeEnsurer(agent))
+
+	keys, err := proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, agent.Loads, 0)
+
+	// the listed key fails to sign, and keeps failing when probed, so it's
+	// loaded again before signing is retried.
+	agent.FailSigns(2)
+	_, err = proxy.Sign(keys[0], []byte("data"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, agent.Loads, 1)
+
+	_, err = proxy.Sign(keys[0], []byte("data"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, agent.Loads, 1)
+
+	// keys that no ensurer is responsible for aren't loaded.
+	proxy.Ensurers[0].KeyPredicate = Not(Any)
+	agent.FailSigns(1)
+	_, err = proxy.Sign(keys[0], []byte("data"))
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, agent.Loads, 1)
+}
+
+func TestProxy_Cooldown(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	loads := 0
+	svc := New(Any, func() error {
+		loads++
+		return errors.New("token unplugged")
+	}).Named("fake")
+	svc.Dial = agent.Dial
+	svc.ProbeTimeout = time.Second
+	proxy := fakeProxy(agent, svc)
+	logs := 0
+	proxy.Logf = func(format string, args ...interface{}) { logs++ }
+	proxy.Cooldown = time.Hour
+
+	// a failed load doesn't fail the listing.
+	keys, err := proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 0)
+	assert.Equal(t, loads, 1)
+	assert.Equal(t, logs > 0, true)
+
+	// clients listing keys again don't prompt again during the cooldown.
+	_, err = proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loads, 1)
+
+	proxy.Cooldown = 0
+	agent.AddPending(rekeytest.GenerateKey("fake"))
+	svc.KeyLoader = agent.Load
+	keys, err = proxy.List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, agent.Loads, 1)
+}
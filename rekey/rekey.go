@@ -2,7 +2,7 @@
 // are availible in your ssh-agent.
 //
 // Specific support is provided for loading Goldkey and Yubikey token keys on
-// macOS.
+// macOS and Linux. Their PKCS#11 modules are found with FindModule.
 package rekey
 
 import (
@@ -12,6 +12,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -26,35 +29,34 @@ const (
 // ConnectAgent returns a new ssh/agent connected to the system default SSH
 // agent over SSH_AUTH_SOCK, or an error if a connection cannot be established.
 func ConnectAgent() (agents.Agent, error) {
-	sockPath, sockSet := os.LookupEnv(SSHAuthSock)
-	if !sockSet {
-		return nil, fmt.Errorf("Can't connect to SSH Agent because %s is unset", SSHAuthSock)
-	}
-	sock, err := net.Dial("unix", sockPath)
+	sock, err := dialAgent()
 	if err != nil {
 		return nil, err
 	}
 	return agents.NewClient(sock), nil
 }
 
+func dialAgent() (net.Conn, error) {
+	sockPath, sockSet := os.LookupEnv(SSHAuthSock)
+	if !sockSet {
+		return nil, fmt.Errorf("Can't connect to SSH Agent because %s is unset", SSHAuthSock)
+	}
+	return net.Dial("unix", sockPath)
+}
+
 // LoadPKCS11 loads the given PKCS11 path into ssh-agent using `ssh-add`.
 func LoadPKCS11(path string) error {
-	cmd := exec.Command(
-		"ssh-add",
-		"-s", path,
-		"-t", AgentLifetime,
-	)
-
-	// pass along IO so users can type into the loader
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return PKCS11Loader(path, 0)()
+}
 
-	return cmd.Run()
+// UnloadPKCS11 removes the keys of the given PKCS11 module from ssh-agent
+// using `ssh-add -e`.
+func UnloadPKCS11(path string) error {
+	return runInteractive(sshAdd("-e", path))
 }
 
 // FindKey searches ssh-agent for the first key that matches the given predicate.
-func FindKey(agent agents.Agent, predicate func(*agents.Key) bool) (*agents.Key, error) {
+func FindKey(agent agents.Agent, predicate Predicate) (*agents.Key, error) {
 	keys, err := agent.List()
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not list ssh-agent's keys")
@@ -69,6 +71,27 @@ func FindKey(agent agents.Agent, predicate func(*agents.Key) bool) (*agents.Key,
 	return nil, nil
 }
 
+// ExpandHome replaces a leading "~/" in path with the current user's home
+// directory.
+func ExpandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	u, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(u.HomeDir, path[2:])
+}
+
+// RestartAgent restarts the agent behind SSH_AUTH_SOCK, dropping all of its
+// keys. See AgentRestarter.
+func RestartAgent() error {
+	return (&AgentRestarter{}).Restart()
+}
+
+// KillSSHAgent kills every ssh-agent run by the current user. Prefer
+// RestartAgent, which only restarts the agent behind SSH_AUTH_SOCK.
 func KillSSHAgent() error {
 	return exec.Command("killall", "ssh-agent").Run()
 }
@@ -0,0 +1,411 @@
+// Package rekeytest provides a scriptable, in-memory ssh-agent and other
+// fakes for testing code built on rekey, without touching SSH_AUTH_SOCK,
+// running ssh-add, or killing real agents.
+//
+// Wire the fakes into a rekey.KeyEnsurer:
+//
+//	agent := rekeytest.NewAgent()
+//	agent.AddPending(rekeytest.GenerateKey("yubikey"))
+//	svc := rekey.New(rekey.Any, agent.Load)
+//	svc.Dial = agent.Dial
+package rekeytest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	agents "golang.org/x/crypto/ssh/agent"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrUnreachable is returned by Dial while the agent is stopped.
+var ErrUnreachable = errors.New("rekeytest: agent is not running")
+
+// ErrSignFailure is returned by Sign while the agent is failing signatures.
+var ErrSignFailure = errors.New("rekeytest: scripted signing failure")
+
+// ErrNotTouched is returned by Sign for a SecurityKey that wasn't touched.
+var ErrNotTouched = errors.New("rekeytest: security key was not touched")
+
+// Agent is an in-memory ssh-agent. Its behavior can be scripted: keys can be
+// added when Load is called, signing can fail, and requests can be slow.
+type Agent struct {
+	mu      sync.Mutex
+	keyring agents.ExtendedAgent
+	pending []agents.AddedKey
+	// securityKeys are listed after the keyring's keys.
+	securityKeys        []*SecurityKey
+	pendingSecurityKeys []*SecurityKey
+	// signFailures is how many more Sign calls should fail.
+	signFailures int
+	delay        time.Duration
+	stopped      bool
+
+	// Loads counts calls to Load.
+	Loads int
+	// Signs counts calls to Sign, including failed ones.
+	Signs int
+}
+
+// NewAgent returns an empty, running Agent.
+func NewAgent() *Agent {
+	return &Agent{keyring: agents.NewKeyring().(agents.ExtendedAgent)}
+}
+
+// GenerateKey returns a new ed25519 key with the given comment.
+func GenerateKey(comment string) agents.AddedKey {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return agents.AddedKey{PrivateKey: private, Comment: comment}
+}
+
+// PublicKey returns the public half of a key from GenerateKey.
+func PublicKey(key agents.AddedKey) ssh.PublicKey {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		panic(err)
+	}
+	return signer.PublicKey()
+}
+
+// AddPending arranges for keys to be added to the agent by the next call to
+// Load, like a token that gets plugged in.
+func (a *Agent) AddPending(keys ...agents.AddedKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, keys...)
+}
+
+// AddPendingSecurityKey arranges for security keys to be added to the agent
+// by the next call to Load, like ssh-add -K loading resident keys.
+func (a *Agent) AddPendingSecurityKey(keys ...*SecurityKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pendingSecurityKeys = append(a.pendingSecurityKeys, keys...)
+}
+
+// AddSecurityKey adds security keys to the agent.
+func (a *Agent) AddSecurityKey(keys ...*SecurityKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.securityKeys = append(a.securityKeys, keys...)
+}
+
+// Load adds the pending keys to the agent. Use it as a KeyLoader.
+func (a *Agent) Load() error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.securityKeys = append(a.securityKeys, a.pendingSecurityKeys...)
+	a.pendingSecurityKeys = nil
+	a.Loads++
+	a.mu.Unlock()
+
+	for _, key := range pending {
+		if err := a.keyring.Add(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FailSigns makes the next n calls to Sign fail.
+func (a *Agent) FailSigns(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.signFailures = n
+}
+
+// SetDelay makes every request wait for d before it is answered, like an
+// agent waiting for a token to be touched.
+func (a *Agent) SetDelay(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.delay = d
+}
+
+// Stop makes Dial fail, as if the agent had exited. Its keys are dropped.
+func (a *Agent) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	a.keyring.RemoveAll()
+	a.securityKeys = nil
+}
+
+// Start undoes Stop.
+func (a *Agent) Start() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = false
+}
+
+// Restart drops all keys, like restarting ssh-agent. Use it as a KeyEnsurer's
+// or Group's Restart.
+func (a *Agent) Restart() error {
+	a.Stop()
+	a.Start()
+	return nil
+}
+
+// Dial returns a connection to the agent, which speaks the agent protocol.
+// Use it as a KeyEnsurer's Dial.
+func (a *Agent) Dial() (net.Conn, error) {
+	a.mu.Lock()
+	stopped := a.stopped
+	a.mu.Unlock()
+	if stopped {
+		return nil, ErrUnreachable
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		agents.ServeAgent(a, server)
+		server.Close()
+	}()
+	return client, nil
+}
+
+// wait sleeps for the scripted delay.
+func (a *Agent) wait() {
+	a.mu.Lock()
+	delay := a.delay
+	a.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// List returns the identities known to the agent.
+func (a *Agent) List() ([]*agents.Key, error) {
+	a.wait()
+	keys, err := a.keyring.List()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range a.securityKeys {
+		keys = append(keys, &agents.Key{
+			Format:  key.public.Type(),
+			Blob:    key.public.Marshal(),
+			Comment: key.Comment,
+		})
+	}
+	return keys, nil
+}
+
+// securityKey returns the security key in the agent with the given public
+// key, if any.
+func (a *Agent) securityKey(key ssh.PublicKey) *SecurityKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, sk := range a.securityKeys {
+		if bytes.Equal(sk.public.Marshal(), key.Marshal()) {
+			return sk
+		}
+	}
+	return nil
+}
+
+// Sign signs data with key, unless a failure was scripted with FailSigns.
+func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign.
+func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agents.SignatureFlags) (*ssh.Signature, error) {
+	a.wait()
+	a.mu.Lock()
+	a.Signs++
+	fail := a.signFailures > 0
+	if fail {
+		a.signFailures--
+	}
+	a.mu.Unlock()
+
+	if fail {
+		return nil, ErrSignFailure
+	}
+	if sk := a.securityKey(key); sk != nil {
+		return sk.sign(data)
+	}
+	return a.keyring.SignWithFlags(key, data, flags)
+}
+
+// Add adds a private key to the agent.
+func (a *Agent) Add(key agents.AddedKey) error {
+	return a.keyring.Add(key)
+}
+
+// Remove removes all identities with the given public key.
+func (a *Agent) Remove(key ssh.PublicKey) error {
+	if sk := a.securityKey(key); sk != nil {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		kept := []*SecurityKey{}
+		for _, other := range a.securityKeys {
+			if other != sk {
+				kept = append(kept, other)
+			}
+		}
+		a.securityKeys = kept
+		return nil
+	}
+	return a.keyring.Remove(key)
+}
+
+// RemoveAll removes all identities.
+func (a *Agent) RemoveAll() error {
+	a.mu.Lock()
+	a.securityKeys = nil
+	a.mu.Unlock()
+	return a.keyring.RemoveAll()
+}
+
+// Lock locks the agent.
+func (a *Agent) Lock(passphrase []byte) error {
+	return a.keyring.Lock(passphrase)
+}
+
+// Unlock undoes the effect of Lock.
+func (a *Agent) Unlock(passphrase []byte) error {
+	return a.keyring.Unlock(passphrase)
+}
+
+// Signers returns signers for all the known keys.
+func (a *Agent) Signers() ([]ssh.Signer, error) {
+	return a.keyring.Signers()
+}
+
+// Extension is not supported.
+func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agents.ErrExtensionUnsupported
+}
+
+// SecurityKey is a fake FIDO security key holding an sk-ssh-ed25519 key, like
+// one made by ssh-keygen -t ed25519-sk. Like a real one, it only signs after
+// it is touched.
+type SecurityKey struct {
+	Comment string
+
+	mu      sync.Mutex
+	private ed25519.PrivateKey
+	public  ssh.PublicKey
+	touches int
+	counter uint32
+}
+
+// GenerateSecurityKey returns a new SecurityKey with the given comment.
+func GenerateSecurityKey(comment string) *SecurityKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	blob := ssh.Marshal(struct {
+		Name        string
+		Key         []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, public, skApplication})
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		panic(err)
+	}
+	return &SecurityKey{Comment: comment, private: private, public: key}
+}
+
+// skApplication is the FIDO application of keys made by ssh-keygen.
+const skApplication = "ssh:"
+
+// PublicKey returns the security key's public key.
+func (k *SecurityKey) PublicKey() ssh.PublicKey {
+	return k.public
+}
+
+// Touch lets the security key make n more signatures.
+func (k *SecurityKey) Touch(n int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.touches += n
+}
+
+// sign makes a signature in the format of sk-ssh-ed25519, if the key was
+// touched.
+func (k *SecurityKey) sign(data []byte) (*ssh.Signature, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.touches == 0 {
+		return nil, ErrNotTouched
+	}
+	k.touches--
+	k.counter++
+
+	const userPresent = 0x01
+	appDigest := sha256.Sum256([]byte(skApplication))
+	dataDigest := sha256.Sum256(data)
+	rest := make([]byte, 5)
+	rest[0] = userPresent
+	binary.BigEndian.PutUint32(rest[1:], k.counter)
+	signed := append(append(appDigest[:], rest...), dataDigest[:]...)
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKED25519,
+		Blob:   ed25519.Sign(k.private, signed),
+		Rest:   rest,
+	}, nil
+}
+
+// Runner records commands instead of running them. Use its Run method as a
+// KeyEnsurer's Run.
+type Runner struct {
+	mu sync.Mutex
+	// Commands holds the argv of every command run, in order.
+	Commands [][]string
+	// Func, if set, is called for each command, and its error returned.
+	Func func(cmd *exec.Cmd) error
+}
+
+// Run records cmd, and calls Func.
+func (r *Runner) Run(cmd *exec.Cmd) error {
+	r.mu.Lock()
+	r.Commands = append(r.Commands, cmd.Args)
+	fn := r.Func
+	r.mu.Unlock()
+
+	if fn != nil {
+		return fn(cmd)
+	}
+	return nil
+}
+
+// Clock is a fake clock that only moves when told to. Use its Now method as a
+// KeyEnsurer's Now.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,152 @@
+package rekey
+
+import (
+	"bytes"
+	"github.com/justjake/encabulator/keyagent"
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	agentSockRegexp = regexp.MustCompile(`SSH_AUTH_SOCK=([^;]+);`)
+	agentPIDRegexp  = regexp.MustCompile(`SSH_AGENT_PID=(\d+);`)
+)
+
+// How long to wait for a killed agent to exit.
+const agentExitTimeout = 2 * time.Second
+
+// AgentEnv describes how to reach an ssh-agent.
+type AgentEnv struct {
+	Sock string
+	// PID of the agent, or 0 if unknown.
+	PID int
+}
+
+// Shell returns commands that point a shell at this agent, in the same format
+// as `ssh-agent -s`.
+func (env *AgentEnv) Shell() string {
+	return keyagent.Exports(env.Sock, env.PID)
+}
+
+// AgentRestarter restarts only the agent behind SSH_AUTH_SOCK, leaving agents
+// that belong to other sessions alone. Use its Restart method as a Group's
+// Restart function.
+type AgentRestarter struct {
+	// Env is set if Restart started a new agent.
+	Env *AgentEnv
+}
+
+// Restart drops all the keys of the agent behind SSH_AUTH_SOCK.
+//
+// An agent run by `encabulator agent` restarts in place. Other agents are
+// found by the process listening on the socket, and killed. If no agent is
+// running afterwards, a new ssh-agent is started on the same socket, and
+// SSH_AUTH_SOCK and SSH_AGENT_PID are updated for this process.
+func (r *AgentRestarter) Restart() error {
+	sockPath := os.Getenv(SSHAuthSock)
+	if sockPath == "" {
+		return r.spawn("")
+	}
+
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		err = restartPeer(conn.(*net.UnixConn), sockPath)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+
+		// launchd and friends may have already started a replacement.
+		if conn, err := net.Dial("unix", sockPath); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Removing stale agent socket")
+	}
+	// ssh-agent removes its socket's directory when it exits.
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+		return err
+	}
+	return r.spawn(sockPath)
+}
+
+// restartPeer restarts the agent at the other end of conn. Only ssh-agent is
+// killed: a socket served by something else, like sshd forwarding an agent or
+// a service manager activating one, is left alone.
+func restartPeer(conn *net.UnixConn, sockPath string) error {
+	err := keyagent.Restart(agents.NewClient(conn))
+	if err != agents.ErrExtensionUnsupported {
+		return err
+	}
+
+	pid, err := keyagent.OwnerPID(conn, sockPath)
+	if err != nil {
+		return errors.Wrap(err, "Finding ssh-agent process")
+	}
+	if name := processName(pid); name != "ssh-agent" {
+		return errors.Errorf("Not restarting the agent: %s is served by %s, not ssh-agent", sockPath, describeProcess(pid))
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return errors.Wrapf(err, "Killing ssh-agent %d", pid)
+	}
+	return waitExit(pid, agentExitTimeout)
+}
+
+func waitExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.Errorf("ssh-agent %d still running after %v", pid, timeout)
+}
+
+// spawn starts a new ssh-agent listening on sockPath, or a random socket if
+// sockPath is empty.
+func (r *AgentRestarter) spawn(sockPath string) error {
+	args := []string{"-s"}
+	if sockPath != "" {
+		args = append(args, "-a", sockPath)
+	}
+	output, err := exec.Command("ssh-agent", args...).Output()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return errors.Wrapf(err, "Starting ssh-agent: %s", bytes.TrimSpace(exit.Stderr))
+	}
+	if err != nil {
+		return errors.Wrap(err, "Starting ssh-agent")
+	}
+
+	env, err := parseAgentEnv(output)
+	if err != nil {
+		return err
+	}
+	os.Setenv(SSHAuthSock, env.Sock)
+	os.Setenv("SSH_AGENT_PID", strconv.Itoa(env.PID))
+	r.Env = env
+	return nil
+}
+
+// parseAgentEnv parses the output of `ssh-agent -s`.
+func parseAgentEnv(output []byte) (*AgentEnv, error) {
+	sock := agentSockRegexp.FindSubmatch(output)
+	if sock == nil {
+		return nil, errors.Errorf("No %s in ssh-agent output %q", SSHAuthSock, output)
+	}
+	env := &AgentEnv{Sock: string(sock[1])}
+	if pid := agentPIDRegexp.FindSubmatch(output); pid != nil {
+		env.PID, _ = strconv.Atoi(string(pid[1]))
+	}
+	return env, nil
+}
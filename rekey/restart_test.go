@@ -0,0 +1,114 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// setenv sets an environment variable, and returns a function that restores
+// its old value, or unsets it.
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func tempAgentSocket(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rekey-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	restoreSock := setenv(SSHAuthSock, sock)
+	restorePID := setenv("SSH_AGENT_PID", "")
+	return sock, func() {
+		restoreSock()
+		restorePID()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentRestarter_RefusesOtherProcesses(t *testing.T) {
+	sock, cleanup := tempAgentSocket(t)
+	defer cleanup()
+
+	// this process stands in for sshd forwarding an agent.
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyring := agents.NewKeyring()
+	keyring.Add(rekeytest.GenerateKey("forwarded"))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agents.ServeAgent(keyring, conn)
+		}
+	}()
+
+	r := &AgentRestarter{}
+	err = r.Restart()
+	assert.Equal(t, err != nil, true)
+	assert.Equal(t, strings.Contains(err.Error(), "not ssh-agent"), true)
+	assert.Equal(t, r.Env == nil, true)
+	keys, _ := keyring.List()
+	assert.Equal(t, len(keys), 1)
+}
+
+func TestAgentRestarter_Spawn(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent is not installed")
+	}
+	sock, cleanup := tempAgentSocket(t)
+	defer cleanup()
+
+	// no agent is running, so one is started on the socket.
+	r := &AgentRestarter{}
+	assert.Equal(t, r.Restart(), nil)
+	assert.Equal(t, r.Env.Sock, sock)
+	first := r.Env.PID
+	defer syscall.Kill(first, syscall.SIGTERM)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents.NewClient(conn).Add(rekeytest.GenerateKey("loaded"))
+	conn.Close()
+
+	// a running ssh-agent is killed, and replaced with an empty one.
+	r = &AgentRestarter{}
+	assert.Equal(t, r.Restart(), nil)
+	assert.Equal(t, r.Env.Sock, sock)
+	defer syscall.Kill(r.Env.PID, syscall.SIGTERM)
+	assert.Equal(t, r.Env.PID != first, true)
+	assert.Equal(t, syscall.Kill(first, 0), syscall.ESRCH)
+
+	conn, err = net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	keys, err := agents.NewClient(conn).List()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(keys), 0)
+}
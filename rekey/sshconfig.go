@@ -0,0 +1,449 @@
+package rekey
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SSHConfigFiles are the ssh config files LookupHost reads by default, in
+// order: the user's, then the system's.
+var SSHConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+// maxIncludeDepth limits nested Includes, like ssh does.
+const maxIncludeDepth = 16
+
+// HostConfig holds the settings from ssh's config files that decide which
+// keys ssh uses to connect to a host.
+type HostConfig struct {
+	// Host is the destination as given to ssh.
+	Host     string
+	HostName string
+	User     string
+	// IdentityFiles and CertificateFiles list paths in the order ssh tries
+	// them, with ~ and %-tokens expanded.
+	IdentityFiles    []string
+	CertificateFiles []string
+	PKCS11Provider   string
+}
+
+// LookupHost works out which keys ssh will use to connect to destination, a
+// host or user@host, by reading the given ssh config files, or SSHConfigFiles
+// if none are given. Like ssh, the first value of each setting wins, except
+// for IdentityFile and CertificateFile, which accumulate.
+//
+// Host and Match blocks and Include directives are followed. Of Match's
+// criteria, all, host, originalhost, user, localuser, and final are
+// supported; exec, canonical, and the rest never match, because LookupHost
+// doesn't run commands or canonicalize host names.
+func LookupHost(destination string, files ...string) (*HostConfig, error) {
+	if len(files) == 0 {
+		files = SSHConfigFiles
+	}
+	r := &sshConfigReader{config: &HostConfig{Host: destination}}
+	if at := strings.LastIndex(destination, "@"); at >= 0 {
+		// a user on the command line beats the config.
+		r.config.User = destination[:at]
+		r.config.Host = destination[at+1:]
+	}
+	if local, err := user.Current(); err == nil {
+		r.localUser = local.Username
+	}
+	for _, path := range files {
+		path = ExpandHome(path)
+		r.dir = filepath.Dir(path)
+		if err := r.readFile(path, true, false, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	config := r.config
+	hostName := r.hostName()
+	for i, path := range config.IdentityFiles {
+		config.IdentityFiles[i] = ExpandHome(r.expand(path, hostName))
+	}
+	for i, path := range config.CertificateFiles {
+		config.CertificateFiles[i] = ExpandHome(r.expand(path, hostName))
+	}
+	if strings.ToLower(config.PKCS11Provider) == "none" {
+		config.PKCS11Provider = ""
+	}
+	if config.PKCS11Provider != "" {
+		config.PKCS11Provider = ExpandHome(r.expand(config.PKCS11Provider, hostName))
+	}
+	config.HostName = hostName
+	config.User = r.remoteUser()
+	return config, nil
+}
+
+type sshConfigReader struct {
+	config    *HostConfig
+	localUser string
+	// dir is where relative Include paths are found: ~/.ssh for the user's
+	// config, /etc/ssh for the system's.
+	dir string
+}
+
+// readFile reads one config file. A missing file is skipped. active says
+// whether settings before the first Host or Match line apply; neverMatch
+// disables every Host and Match, for files included from an inactive block.
+func (r *sshConfigReader) readFile(path string, active bool, neverMatch bool, depth int) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Reading ssh config")
+	}
+	defer file.Close()
+	return r.read(file, path, active, neverMatch, depth)
+}
+
+func (r *sshConfigReader) read(in io.Reader, path string, active bool, neverMatch bool, depth int) error {
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return errors.Wrapf(err, "%s line %d", path, line)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			active = !neverMatch && r.matchHost(args)
+		case "match":
+			matched, err := r.match(args)
+			if err != nil {
+				return errors.Wrapf(err, "%s line %d", path, line)
+			}
+			active = !neverMatch && matched
+		case "include":
+			if depth >= maxIncludeDepth {
+				return errors.Errorf("%s line %d: Too many nested Includes", path, line)
+			}
+			for _, pattern := range args {
+				pattern = ExpandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(r.dir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return errors.Wrapf(err, "%s line %d", path, line)
+				}
+				sort.Strings(matches)
+				for _, included := range matches {
+					if err := r.readFile(included, active, neverMatch || !active, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if active {
+				r.set(keyword, args)
+			}
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "Reading %s", path)
+}
+
+// set applies a setting from an active block.
+func (r *sshConfigReader) set(keyword string, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	config := r.config
+	switch keyword {
+	case "hostname":
+		if config.HostName == "" {
+			config.HostName = args[0]
+		}
+	case "user":
+		if config.User == "" {
+			config.User = args[0]
+		}
+	case "pkcs11provider":
+		if config.PKCS11Provider == "" {
+			config.PKCS11Provider = args[0]
+		}
+	case "identityfile":
+		config.IdentityFiles = append(config.IdentityFiles, args[0])
+	case "certificatefile":
+		config.CertificateFiles = append(config.CertificateFiles, args[0])
+	}
+}
+
+// matchHost matches the patterns of a Host line against the host as given to
+// ssh.
+func (r *sshConfigReader) matchHost(patterns []string) bool {
+	return matchPatternList(strings.ToLower(r.config.Host), lower(patterns))
+}
+
+// match evaluates the criteria of a Match line. All of them must match.
+func (r *sshConfigReader) match(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, errors.New("Match needs criteria")
+	}
+	matched := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var ok bool
+		switch criterion {
+		case "all":
+			ok = true
+		case "final":
+			// we only make one pass, which is the final one.
+			ok = true
+		case "canonical":
+			ok = false
+		default:
+			if i+1 >= len(args) {
+				return false, errors.Errorf("Match %s needs an argument", criterion)
+			}
+			i++
+			patterns := strings.Split(args[i], ",")
+			switch criterion {
+			case "host":
+				ok = matchPatternList(strings.ToLower(r.hostName()), lower(patterns))
+			case "originalhost":
+				ok = matchPatternList(strings.ToLower(r.config.Host), lower(patterns))
+			case "user":
+				ok = matchPatternList(r.remoteUser(), patterns)
+			case "localuser":
+				ok = matchPatternList(r.localUser, patterns)
+			default:
+				// exec, localnetwork, tagged, and anything newer.
+				ok = false
+			}
+		}
+		if ok == negate {
+			matched = false
+		}
+	}
+	return matched, nil
+}
+
+// hostName returns the host ssh will connect to, given the settings so far.
+func (r *sshConfigReader) hostName() string {
+	if r.config.HostName == "" {
+		return r.config.Host
+	}
+	return r.expand(r.config.HostName, r.config.Host)
+}
+
+func (r *sshConfigReader) remoteUser() string {
+	if r.config.User == "" {
+		return r.localUser
+	}
+	return r.config.User
+}
+
+// expand replaces the %-tokens ssh supports in paths: %% %d %h %i %n %r %u.
+// %h is replaced with host. Unknown tokens are left alone.
+func (r *sshConfigReader) expand(value string, host string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+	var out bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			out.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case '%':
+			out.WriteByte('%')
+		case 'd':
+			out.WriteString(ExpandHome("~/"))
+		case 'h':
+			out.WriteString(host)
+		case 'i':
+			fmt.Fprint(&out, os.Getuid())
+		case 'n':
+			out.WriteString(r.config.Host)
+		case 'r':
+			out.WriteString(r.remoteUser())
+		case 'u':
+			out.WriteString(r.localUser)
+		default:
+			out.WriteByte('%')
+			out.WriteByte(value[i])
+		}
+	}
+	return out.String()
+}
+
+// splitSSHConfigLine splits a config line into its lowercased keyword and its
+// arguments. The keyword may be followed by whitespace or "=", and arguments
+// may be double-quoted. Blank lines and comments return an empty keyword.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexFunc(line, func(c rune) bool { return unicode.IsSpace(c) || c == '=' })
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeftFunc(line[end:], unicode.IsSpace)
+	rest = strings.TrimPrefix(rest, "=")
+
+	args := []string{}
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			return keyword, args, nil
+		}
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return "", nil, errors.New("Unbalanced quotes")
+			}
+			args = append(args, rest[1:closing+1])
+			rest = rest[closing+2:]
+			continue
+		}
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// matchPatternList matches s against ssh patterns, which may use * and ?. It
+// matches if any pattern matches, unless a negated pattern (!pattern) does.
+func matchPatternList(s string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(s, pattern[1:]) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(s, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+func lower(patterns []string) []string {
+	lowered := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lowered[i] = strings.ToLower(pattern)
+	}
+	return lowered
+}
+
+// matchPattern matches s against a pattern where * matches any run of
+// characters and ? matches one character.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s = s[1:]
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// Ensurers builds a KeyEnsurer for each key the config names: one for the
+// PKCS#11 provider, and one for each identity file that exists, which ssh
+// would otherwise skip. An identity with a certificate among the
+// CertificateFiles is only satisfied by a valid certificate. Returns no
+// ensurers if the config names no keys, in which case ssh tries every key in
+// the agent.
+func (h *HostConfig) Ensurers() ([]*KeyEnsurer, error) {
+	ensurers := []*KeyEnsurer{}
+	if provider := h.PKCS11Provider; provider != "" {
+		name := strings.TrimSuffix(filepath.Base(provider), filepath.Ext(provider))
+		svc := New(ByComment(regexp.MustCompile(regexp.QuoteMeta(name))), nil).Named(name)
+		svc.KeyLoader = func() error { return moduleLoader(provider, svc.Lifetime, svc.run)() }
+		svc.KeyUnloader = moduleUnloader(provider, svc.run)
+		ensurers = append(ensurers, svc)
+	}
+
+	seen := make(map[string]bool)
+	for _, path := range h.IdentityFiles {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		pub, err := readPublicKey(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ensurers = append(ensurers, h.identityEnsurer(path, pub))
+	}
+	return ensurers, nil
+}
+
+// identityEnsurer builds the KeyEnsurer for an identity file.
+func (h *HostConfig) identityEnsurer(path string, pub ssh.PublicKey) *KeyEnsurer {
+	predicate := ByFingerprint(Fingerprint(pub))
+	svc := New(predicate, nil).Named(filepath.Base(path))
+
+	certs := []string{}
+	for _, certPath := range h.CertificateFiles {
+		cert, err := readCertificate(certPath)
+		if err == nil && bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+			certs = append(certs, certPath)
+		}
+	}
+	if len(certs) > 0 {
+		svc.KeyPredicate = ByCertificate(CertRule{}, predicate, svc.now)
+	}
+
+	if strings.HasPrefix(pub.Type(), "sk-") {
+		// KeyFileLoader can't parse security keys.
+		svc.KeyLoader = func() error { return fileLoader(path, svc.Lifetime, svc.run)() }
+		return svc
+	}
+	svc.KeyLoader = func() error {
+		loader := &KeyFileLoader{
+			Paths:        []string{path},
+			Certificates: certs,
+			Lifetime:     svc.Lifetime,
+			Dial:         svc.dial,
+		}
+		return loader.Load()
+	}
+	return svc
+}
@@ -0,0 +1,135 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSSHConfig = `# comments and blank lines are skipped
+Include conf.d/*.conf
+
+Host github.com gist.github.com
+	User git
+	IdentityFile %d/.ssh/id_github
+
+Host *.corp !bastion.corp
+	HostName %h.example.com
+	IdentityFile ~/.ssh/id_%r
+	CertificateFile ~/.ssh/id_%r-cert.pub
+
+Match host *.example.com user deploy
+	PKCS11Provider /usr/lib/libykcs11.so
+
+Match exec "true"
+	IdentityFile ~/.ssh/id_never
+
+Host *
+	IdentityFile=~/.ssh/id_default
+	User nobody
+`
+
+const testIncludedSSHConfig = `IdentityFile ~/.ssh/id_included_%n
+
+Host other
+	IdentityFile ~/.ssh/id_other
+`
+
+func writeSSHConfig(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rekey-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testSSHConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	included := filepath.Join(dir, "conf.d", "a.conf")
+	if err := ioutil.WriteFile(included, []byte(testIncludedSSHConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLookupHost(t *testing.T) {
+	path, cleanup := writeSSHConfig(t)
+	defer cleanup()
+
+	host, err := LookupHost("GitHub.com", path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, host.User, "git")
+	assert.Equal(t, host.HostName, "GitHub.com")
+	assert.Equal(t, host.IdentityFiles, []string{
+		ExpandHome("~/.ssh/id_included_GitHub.com"),
+		ExpandHome("~/.ssh/id_github"),
+		ExpandHome("~/.ssh/id_default"),
+	})
+	assert.Equal(t, host.PKCS11Provider, "")
+
+	host, err = LookupHost("deploy@web.corp", path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, host.HostName, "web.corp.example.com")
+	assert.Equal(t, host.IdentityFiles, []string{
+		ExpandHome("~/.ssh/id_included_web.corp"),
+		ExpandHome("~/.ssh/id_deploy"),
+		ExpandHome("~/.ssh/id_default"),
+	})
+	assert.Equal(t, host.CertificateFiles, []string{ExpandHome("~/.ssh/id_deploy-cert.pub")})
+	assert.Equal(t, host.PKCS11Provider, "/usr/lib/libykcs11.so")
+
+	// negated patterns exclude a host.
+	host, err = LookupHost("bastion.corp", path)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, host.User, "nobody")
+	assert.Equal(t, host.HostName, "bastion.corp")
+}
+
+func TestLookupHost_IncludeInInactiveBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := "Host nowhere\n\tInclude other\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := "IdentityFile ~/.ssh/id_a\nHost *\n\tIdentityFile ~/.ssh/id_b\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte(other), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := LookupHost("example.com", filepath.Join(dir, "config"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(host.IdentityFiles), 0)
+}
+
+func TestHostConfig_Ensurers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub := writeKey(t, filepath.Join(dir, "id_work"), "work@example", "")
+	host := &HostConfig{
+		IdentityFiles: []string{
+			filepath.Join(dir, "id_work"),
+			filepath.Join(dir, "id_missing"),
+			filepath.Join(dir, "id_work"),
+		},
+		PKCS11Provider: "/usr/lib/libykcs11.so",
+	}
+	ensurers, err := host.Ensurers()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(ensurers), 2)
+	assert.Equal(t, ensurers[0].String(), "libykcs11")
+	assert.Equal(t, ensurers[1].String(), "id_work")
+	assert.Equal(t, ensurers[1].KeyPredicate(&agents.Key{Format: pub.Type(), Blob: pub.Marshal()}), true)
+}
@@ -0,0 +1,205 @@
+package rekey
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultLifetime is how long keys stay in the agent when a KeyEnsurer or
+// Profile doesn't set a Lifetime. It matches AgentLifetime.
+const DefaultLifetime = 14400 * time.Second
+
+// Forever, as a Lifetime, keeps keys in the agent until it exits, like plain
+// `ssh-add`. Keys loaded forever never need refreshing.
+const Forever time.Duration = -1
+
+// State remembers when rekey loaded each key, because ssh-agent doesn't tell
+// us when a key will expire. It is saved as JSON, by default in
+// ~/.encabulator/rekey-state.json.
+//
+// Probe records are saved in a separate file next to it, because they are
+// written after every probe, without holding the FileLock. Concurrent
+// writers may lose each other's probes, which only costs a sign, but never
+// the load records in the state file.
+type State struct {
+	// Keys maps KeyEnsurer names to the last time each was loaded.
+	Keys map[string]*KeyState `json:"keys"`
+	// Probes maps KeyEnsurer names to the last time each key signed a probe.
+	// See SaveProbes.
+	Probes map[string]*ProbeState `json:"-"`
+	path   string
+}
+
+// KeyState records one load of a key.
+type KeyState struct {
+	// Sock is the SSH_AUTH_SOCK of the agent the key was loaded into. Records
+	// for other agents are ignored.
+	Sock     string    `json:"sock"`
+	LoadedAt time.Time `json:"loadedAt"`
+	Expires  time.Time `json:"expires"`
+}
+
+// ProbeState records the last successful sign probe of a key. See
+// KeyEnsurer.ProbeCacheTTL.
+type ProbeState struct {
+	Sock        string    `json:"sock"`
+	Fingerprint string    `json:"fingerprint"`
+	VerifiedAt  time.Time `json:"verifiedAt"`
+}
+
+// DefaultStatePath returns the path of the state file used by the encabulator
+// command.
+func DefaultStatePath() string {
+	return ExpandHome("~/.encabulator/rekey-state.json")
+}
+
+// LoadState reads the state file at path. A missing file is an empty State.
+func LoadState(path string) (*State, error) {
+	state := &State{
+		Keys:   make(map[string]*KeyState),
+		Probes: make(map[string]*ProbeState),
+		path:   path,
+	}
+	if err := readJSON(path, state); err != nil {
+		return nil, err
+	}
+	if state.Keys == nil {
+		state.Keys = make(map[string]*KeyState)
+	}
+	if err := state.ReloadProbes(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// probesPath returns the path of the file probe records are saved in, eg
+// rekey-state-probes.json next to rekey-state.json.
+func (s *State) probesPath() string {
+	ext := filepath.Ext(s.path)
+	return strings.TrimSuffix(s.path, ext) + "-probes" + ext
+}
+
+// readJSON parses the JSON file at path into v. A missing file leaves v alone.
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Reading rekey state")
+	}
+	return errors.Wrapf(json.Unmarshal(data, v), "Parsing rekey state %s", path)
+}
+
+// Reload reads the state file again, to pick up keys loaded by other
+// processes.
+func (s *State) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	loaded, err := LoadState(s.path)
+	if err != nil {
+		return err
+	}
+	s.Keys = loaded.Keys
+	s.Probes = loaded.Probes
+	return nil
+}
+
+// ReloadProbes reads the probe records again, leaving Keys alone.
+func (s *State) ReloadProbes() error {
+	s.Probes = make(map[string]*ProbeState)
+	if s.path == "" {
+		return nil
+	}
+	return readJSON(s.probesPath(), &s.Probes)
+}
+
+// SaveProbes writes the probe records back to their file, next to the state
+// file.
+func (s *State) SaveProbes() error {
+	return writeJSON(s.probesPath(), s.Probes)
+}
+
+// Save writes the load records back to the file the state was loaded from.
+// The file is replaced atomically, so readers never see a partial write.
+func (s *State) Save() error {
+	return writeJSON(s.path, s)
+}
+
+// writeJSON atomically replaces the file at path with v as JSON.
+func writeJSON(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "Creating state directory")
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".rekey-state")
+	if err != nil {
+		return errors.Wrap(err, "Writing rekey state")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Writing rekey state")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Writing rekey state")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "Writing rekey state")
+}
+
+// Loaded records that the named key was loaded into the current agent at now,
+// and will expire after lifetime.
+func (s *State) Loaded(name string, lifetime time.Duration, now time.Time) {
+	s.Keys[name] = &KeyState{
+		Sock:     os.Getenv(SSHAuthSock),
+		LoadedAt: now,
+		Expires:  now.Add(lifetime),
+	}
+}
+
+// Expires returns when the named key will expire from the current agent, if
+// rekey loaded it.
+func (s *State) Expires(name string) (time.Time, bool) {
+	key, ok := s.Keys[name]
+	if !ok || key.Sock != os.Getenv(SSHAuthSock) {
+		return time.Time{}, false
+	}
+	return key.Expires, true
+}
+
+// Verified records that the named key, with the given fingerprint, signed a
+// probe in the current agent at now.
+func (s *State) Verified(name string, fingerprint string, now time.Time) {
+	if s.Probes == nil {
+		s.Probes = make(map[string]*ProbeState)
+	}
+	s.Probes[name] = &ProbeState{
+		Sock:        os.Getenv(SSHAuthSock),
+		Fingerprint: fingerprint,
+		VerifiedAt:  now,
+	}
+}
+
+// Unverified forgets the last probe of the named key.
+func (s *State) Unverified(name string) {
+	delete(s.Probes, name)
+}
+
+// VerifiedSince returns true if the named key, with the given fingerprint,
+// signed a probe in the current agent at or after since.
+func (s *State) VerifiedSince(name string, fingerprint string, since time.Time) bool {
+	probe, ok := s.Probes[name]
+	if !ok || probe.Sock != os.Getenv(SSHAuthSock) || probe.Fingerprint != fingerprint {
+		return false
+	}
+	return !probe.VerifiedAt.Before(since)
+}
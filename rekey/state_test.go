@@ -0,0 +1,84 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestState_SaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(SSHAuthSock, os.Getenv(SSHAuthSock))
+	os.Setenv(SSHAuthSock, "/tmp/agent.sock")
+
+	path := filepath.Join(dir, "nested", "state.json")
+	state, err := LoadState(path)
+	assert.Equal(t, err, nil)
+	_, ok := state.Expires("yubikey")
+	assert.Equal(t, ok, false)
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	state.Loaded("yubikey", time.Hour, now)
+	assert.Equal(t, state.Save(), nil)
+
+	state, err = LoadState(path)
+	assert.Equal(t, err, nil)
+	expires, ok := state.Expires("yubikey")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, expires.Equal(now.Add(time.Hour)), true)
+
+	// loads into other agents don't count.
+	os.Setenv(SSHAuthSock, "/tmp/other.sock")
+	_, ok = state.Expires("yubikey")
+	assert.Equal(t, ok, false)
+}
+
+func TestKeyEnsurer_Expiring(t *testing.T) {
+	defer os.Setenv(SSHAuthSock, os.Getenv(SSHAuthSock))
+	os.Setenv(SSHAuthSock, "/tmp/agent.sock")
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	state := &State{Keys: make(map[string]*KeyState)}
+	state.Loaded("id", time.Hour, now)
+	svc := DefaultIdentity()
+	assert.Equal(t, svc.Expiring(now), false)
+
+	svc.State = state
+	svc.RefreshBefore = 10 * time.Minute
+	assert.Equal(t, svc.Expiring(now.Add(45*time.Minute)), false)
+	assert.Equal(t, svc.Expiring(now.Add(55*time.Minute)), true)
+}
+
+func TestState_ProbesDontClobberLoads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// two rekeys read the state at once.
+	loader, err := LoadState(path)
+	assert.Equal(t, err, nil)
+	prober, err := LoadState(path)
+	assert.Equal(t, err, nil)
+
+	loader.Loaded("yubikey", time.Hour, now)
+	assert.Equal(t, loader.Save(), nil)
+	prober.Verified("id", "SHA256:abc", now)
+	assert.Equal(t, prober.SaveProbes(), nil)
+
+	state, err := LoadState(path)
+	assert.Equal(t, err, nil)
+	_, ok := state.Expires("yubikey")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, state.VerifiedSince("id", "SHA256:abc", now), true)
+}
@@ -0,0 +1,151 @@
+package rekey
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// KeyStatus describes a key held by ssh-agent.
+type KeyStatus struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Comment     string `json:"comment"`
+	// Profiles lists the names of the KeyEnsurers this key satisfies.
+	Profiles []string `json:"profiles"`
+	// Usable is true if the agent signed a test challenge with the key.
+	Usable bool `json:"usable"`
+	// Error explains why the key is not usable.
+	Error string `json:"error,omitempty"`
+	// Expires is when the agent will drop the key, if rekey loaded it.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Certificate describes the key's certificate, if it is one.
+	Certificate *CertificateStatus `json:"certificate,omitempty"`
+}
+
+// CertificateStatus describes an OpenSSH certificate held by ssh-agent.
+type CertificateStatus struct {
+	KeyID       string    `json:"keyId"`
+	Principals  []string  `json:"principals"`
+	ValidBefore time.Time `json:"validBefore"`
+}
+
+// StatusReport describes everything ssh-agent holds.
+type StatusReport struct {
+	Keys []*KeyStatus `json:"keys"`
+	// Missing lists the KeyEnsurers that no key satisfies.
+	Missing []string `json:"missing"`
+}
+
+// Status lists every key in the agent behind SSH_AUTH_SOCK, and checks which
+// of the given KeyEnsurers each key satisfies. Each key is asked to sign a
+// test challenge, giving up after timeout.
+func Status(ensurers []*KeyEnsurer, timeout time.Duration) (*StatusReport, error) {
+	return status(ensurers, timeout, dialAgent)
+}
+
+func status(ensurers []*KeyEnsurer, timeout time.Duration, dial func() (net.Conn, error)) (*StatusReport, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, &AgentUnreachableError{err}
+	}
+	keys, err := agents.NewClient(conn).List()
+	conn.Close()
+	if err != nil {
+		return nil, &AgentUnreachableError{errors.Wrap(err, "Listing keys")}
+	}
+
+	report := &StatusReport{Keys: []*KeyStatus{}, Missing: []string{}}
+	now := time.Now()
+	satisfied := make(map[*KeyEnsurer]bool)
+	for _, key := range keys {
+		status := &KeyStatus{
+			Fingerprint: Fingerprint(key),
+			Type:        key.Type(),
+			Comment:     key.Comment,
+			Profiles:    []string{},
+		}
+		if cert := Certificate(key); cert != nil {
+			status.Certificate = &CertificateStatus{
+				KeyID:       cert.KeyId,
+				Principals:  append([]string{}, cert.ValidPrincipals...),
+				ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+			}
+		}
+		for _, svc := range ensurers {
+			if svc.KeyPredicate(key) {
+				status.Profiles = append(status.Profiles, svc.String())
+				satisfied[svc] = true
+				if expires, ok := svc.Expires(); ok && expires.After(now) && (status.Expires == nil || expires.Before(*status.Expires)) {
+					status.Expires = &expires
+				}
+			}
+		}
+
+		err := probeStatus(key, timeout, dial)
+		status.Usable = err == nil
+		if err != nil {
+			status.Error = err.Error()
+		}
+		report.Keys = append(report.Keys, status)
+	}
+
+	for _, svc := range ensurers {
+		if !satisfied[svc] {
+			report.Missing = append(report.Missing, svc.String())
+		}
+	}
+	return report, nil
+}
+
+// probeStatus asks the agent to sign a test challenge with key. Each key gets
+// its own connection, since a probe that times out closes it.
+func probeStatus(key *agents.Key, timeout time.Duration, dial func() (net.Conn, error)) error {
+	conn, err := dial()
+	if err != nil {
+		return &AgentUnreachableError{err}
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return probeSign(ctx, agents.NewClient(conn), key, func() { conn.Close() })
+}
+
+// Print writes a human-readable table of the report to w.
+func (r *StatusReport) Print(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	now := time.Now()
+	if len(r.Keys) == 0 {
+		fmt.Fprintln(table, "The agent has no identities.")
+	}
+	for _, key := range r.Keys {
+		usable := "ok"
+		if !key.Usable {
+			usable = "unusable: " + key.Error
+		}
+		expires := ""
+		if key.Expires != nil {
+			expires = fmt.Sprintf("expires in %v", key.Expires.Sub(now).Round(time.Minute))
+		}
+		if cert := key.Certificate; cert != nil {
+			if cert.ValidBefore.After(now) {
+				expires = strings.TrimSpace(fmt.Sprintf("%s  cert valid for %v", expires, cert.ValidBefore.Sub(now).Round(time.Minute)))
+			} else {
+				expires = strings.TrimSpace(expires + "  cert expired")
+			}
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t[%s]\t%s\t%s\n",
+			key.Fingerprint, key.Type, key.Comment, strings.Join(key.Profiles, ", "), usable, expires)
+	}
+	if len(r.Missing) > 0 {
+		fmt.Fprintf(table, "Missing: %s\n", strings.Join(r.Missing, ", "))
+	}
+	return table.Flush()
+}
@@ -0,0 +1,36 @@
+package rekey
+
+import (
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatus_TimeoutDoesNotSpoilOtherKeys(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	slow := rekeytest.NewAgent()
+	for _, key := range []string{"touch me", "soft"} {
+		generated := rekeytest.GenerateKey(key)
+		agent.Add(generated)
+		slow.Add(generated)
+	}
+	slow.SetDelay(time.Second)
+
+	// the first key's probe waits for a touch that never comes.
+	dials := 0
+	dial := func() (net.Conn, error) {
+		dials++
+		if dials == 2 {
+			return slow.Dial()
+		}
+		return agent.Dial()
+	}
+
+	report, err := status(nil, 50*time.Millisecond, dial)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(report.Keys), 2)
+	assert.Equal(t, report.Keys[0].Usable, false)
+	assert.Equal(t, report.Keys[1].Usable, true)
+}
@@ -0,0 +1,129 @@
+package rekey
+
+import (
+	"github.com/pkg/errors"
+	agents "golang.org/x/crypto/ssh/agent"
+)
+
+// Unload removes the key from the agent. If any matching keys are loaded,
+// KeyUnloader runs first, since it also unregisters PKCS#11 modules; then any
+// keys still matching KeyPredicate are removed one by one, along with the
+// plain keys of matching certificates. If KeyUnloader fails, the keys are
+// still removed one by one, and its error is only returned if that fails too.
+// Returns the number of matching keys that were loaded.
+func (svc *KeyEnsurer) Unload() (int, error) {
+	keys, err := svc.matching()
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, svc.forget()
+	}
+
+	var unloadErr error
+	if svc.KeyUnloader != nil {
+		if err := svc.KeyUnloader(); err != nil {
+			unloadErr = errors.Wrap(err, "KeyUnloader")
+		}
+		// the agent may not have kept our connection.
+		svc.disconnect()
+	}
+
+	remaining, err := svc.matching()
+	if err != nil {
+		return len(keys), withUnloadErr(err, unloadErr)
+	}
+	for _, key := range remaining {
+		if err := svc.agent.Remove(key); err != nil {
+			return len(keys), withUnloadErr(errors.Wrapf(err, "Removing %s", key.Comment), unloadErr)
+		}
+		if cert := Certificate(key); cert != nil {
+			// the key was added along with its certificate, and is useless
+			// without it.
+			svc.agent.Remove(cert.Key)
+		}
+	}
+	return len(keys), svc.forget()
+}
+
+// matching lists the keys in the agent that match KeyPredicate.
+func (svc *KeyEnsurer) matching() ([]*agents.Key, error) {
+	if err := svc.connect(); err != nil {
+		return nil, &AgentUnreachableError{err}
+	}
+	keys, err := svc.agent.List()
+	if err != nil {
+		svc.disconnect()
+		return nil, &AgentUnreachableError{err}
+	}
+	matching := []*agents.Key{}
+	for _, key := range keys {
+		if svc.KeyPredicate(key) {
+			matching = append(matching, key)
+		}
+	}
+	return matching, nil
+}
+
+// withUnloadErr adds the error of a failed KeyUnloader, if any, to err.
+func withUnloadErr(err, unloadErr error) error {
+	if unloadErr == nil {
+		return err
+	}
+	return errors.Wrapf(err, "%v, then", unloadErr)
+}
+
+// forget drops the key's records from State, holding the Lock while it saves.
+func (svc *KeyEnsurer) forget() error {
+	if svc.State == nil {
+		return nil
+	}
+	if svc.Lock != nil {
+		// lock reloads the State.
+		unlock, err := svc.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	} else if err := svc.State.Reload(); err != nil {
+		return err
+	}
+	name := svc.String()
+	if _, ok := svc.State.Keys[name]; !ok {
+		if _, ok := svc.State.Probes[name]; !ok {
+			return nil
+		}
+	}
+	delete(svc.State.Keys, name)
+	svc.State.Unverified(name)
+	if err := svc.State.SaveProbes(); err != nil {
+		return err
+	}
+	return svc.State.Save()
+}
+
+// LockAgent locks the agent behind SSH_AUTH_SOCK with a passphrase. A locked
+// agent lists no keys and refuses to sign until it is unlocked.
+func LockAgent(passphrase []byte) error {
+	return withAgent(func(agent agents.Agent) error {
+		return errors.Wrap(agent.Lock(passphrase), "Locking agent")
+	})
+}
+
+// UnlockAgent unlocks the agent behind SSH_AUTH_SOCK.
+func UnlockAgent(passphrase []byte) error {
+	return withAgent(func(agent agents.Agent) error {
+		return errors.Wrap(agent.Unlock(passphrase), "Unlocking agent")
+	})
+}
+
+// withAgent runs fn against a new connection to the agent behind
+// SSH_AUTH_SOCK.
+func withAgent(fn func(agent agents.Agent) error) error {
+	conn, err := dialAgent()
+	if err != nil {
+		return &AgentUnreachableError{err}
+	}
+	defer conn.Close()
+	return fn(agents.NewClient(conn))
+}
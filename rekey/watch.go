@@ -0,0 +1,125 @@
+package rekey
+
+import (
+	"context"
+	"github.com/justjake/encabulator/task"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// Watcher keeps keys loaded. It periodically probes each KeyEnsurer, and
+// reloads keys that disappear from the agent or stop signing, or that are
+// about to expire. Keys that keep failing to load, for example because the
+// token is unplugged, are retried with exponential backoff.
+type Watcher struct {
+	Ensurers []*KeyEnsurer
+	// Interval between probes.
+	Interval time.Duration
+	// After MaxFailures failed loads Within a period, the watcher backs off.
+	MaxFailures int
+	Within      time.Duration
+	// MaxBackoff caps the delay between attempts to load a failing key.
+	MaxBackoff time.Duration
+	// Logf logs reloads and failures. Defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+}
+
+// watched is the Watcher's bookkeeping for one KeyEnsurer.
+type watched struct {
+	svc      *KeyEnsurer
+	failures *task.FailureWindow
+	backoff  time.Duration
+	next     time.Time
+}
+
+// NewWatcher returns a Watcher for the given ensurers with reasonable
+// defaults.
+func NewWatcher(ensurers ...*KeyEnsurer) *Watcher {
+	return &Watcher{
+		Ensurers:    ensurers,
+		Interval:    time.Minute,
+		MaxFailures: 3,
+		Within:      10 * time.Minute,
+		MaxBackoff:  30 * time.Minute,
+		Logf:        log.Printf,
+	}
+}
+
+// Run watches the keys until ctx is done. Fails right away if Interval isn't
+// positive.
+func (w *Watcher) Run(ctx context.Context) error {
+	if w.Interval <= 0 {
+		return errors.Errorf("Watch interval must be positive, not %v", w.Interval)
+	}
+	keys := make([]*watched, len(w.Ensurers))
+	for i, svc := range w.Ensurers {
+		keys[i] = w.watch(svc)
+	}
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, key := range keys {
+			if now.Before(key.next) {
+				continue
+			}
+			w.check(ctx, key, now)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) watch(svc *KeyEnsurer) *watched {
+	return &watched{svc: svc, failures: task.MakeFailureWindow(w.MaxFailures, w.Within)}
+}
+
+// check probes a key, and reloads it if needed.
+func (w *Watcher) check(ctx context.Context, key *watched, now time.Time) {
+	err := key.svc.Probe(ctx)
+	switch {
+	case err == nil && key.svc.Expiring(now):
+		expires, _ := key.svc.Expires()
+		w.Logf("%s: expires in %v; refreshing", key.svc, expires.Sub(now).Round(time.Second))
+	case err == nil:
+		key.backoff = 0
+		return
+	case IsUnreachable(err), IsPresenceRequired(err):
+		// nothing to load keys into, or the key is loaded but wasn't touched.
+		w.Logf("%s: %v", key.svc, err)
+		return
+	default:
+		w.Logf("%s: %v; reloading", key.svc, err)
+	}
+
+	if err := key.svc.ensure(ctx, err); err != nil {
+		w.Logf("%s: %v", key.svc, err)
+		if key.failures.Fail(now) {
+			key.backoff = w.nextBackoff(key.backoff)
+			key.next = now.Add(key.backoff)
+			w.Logf("%s: too many failures, waiting %v", key.svc, key.backoff)
+		}
+		return
+	}
+
+	key.failures.Zero()
+	key.backoff = 0
+	w.Logf("%s: reloaded", key.svc)
+}
+
+func (w *Watcher) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return w.Interval
+	}
+	backoff *= 2
+	if backoff > w.MaxBackoff {
+		return w.MaxBackoff
+	}
+	return backoff
+}
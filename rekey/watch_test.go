@@ -0,0 +1,114 @@
+package rekey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/justjake/encabulator/assert"
+	"github.com/justjake/encabulator/rekey/rekeytest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcher_ReloadsVanishedKey(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	key := rekeytest.GenerateKey("fake")
+	agent.Add(key)
+	svc := fakeEnsurer(agent)
+
+	// the key vanishes, say because the token was replugged.
+	agent.Remove(rekeytest.PublicKey(key))
+	agent.AddPending(key)
+
+	logs := make(chan string, 10)
+	w := NewWatcher(svc)
+	w.Interval = 10 * time.Millisecond
+	w.Logf = func(format string, args ...interface{}) {
+		logs <- fmt.Sprintf(format, args...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	for log := range logs {
+		if strings.HasSuffix(log, "reloaded") {
+			break
+		}
+	}
+	cancel()
+	assert.Equal(t, <-done, context.Canceled)
+	assert.Equal(t, agent.Loads, 1)
+}
+
+func TestWatcher_Interval(t *testing.T) {
+	w := NewWatcher()
+	w.Interval = 0
+	assert.Equal(t, w.Run(context.Background()) != nil, true)
+}
+
+// unpluggedToken returns a KeyEnsurer whose key is missing and fails to load,
+// and counts its loads.
+func unpluggedToken(agent *rekeytest.Agent, loads *int) *KeyEnsurer {
+	svc := New(Any, func() error {
+		*loads++
+		return errors.New("token unplugged")
+	}).Named("token")
+	svc.Dial = agent.Dial
+	svc.ProbeTimeout = time.Second
+	return svc
+}
+
+func TestWatcher_Backoff(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	loads := 0
+	svc := unpluggedToken(agent, &loads)
+	w := NewWatcher(svc)
+	w.Interval = time.Minute
+	w.MaxFailures = 2
+	w.Within = 10 * time.Minute
+	w.MaxBackoff = 4 * time.Minute
+	w.Logf = func(format string, args ...interface{}) {}
+	key := w.watch(svc)
+
+	now := time.Now()
+	backoffs := []time.Duration{}
+	for i := 0; i < 6; i++ {
+		w.check(context.Background(), key, now)
+		backoffs = append(backoffs, key.backoff)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, loads, 6)
+	// the third failure within the window backs off, doubling up to MaxBackoff.
+	assert.Equal(t, backoffs, []time.Duration{
+		0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute,
+	})
+	assert.Equal(t, key.next, now.Add(-time.Minute).Add(4*time.Minute))
+
+	// the token is plugged back in.
+	agent.AddPending(rekeytest.GenerateKey("token"))
+	svc.KeyLoader = agent.Load
+	w.check(context.Background(), key, now)
+	assert.Equal(t, agent.Loads, 1)
+	assert.Equal(t, key.backoff, time.Duration(0))
+}
+
+func TestWatcher_FailureWindow(t *testing.T) {
+	agent := rekeytest.NewAgent()
+	loads := 0
+	svc := unpluggedToken(agent, &loads)
+	w := NewWatcher(svc)
+	w.MaxFailures = 2
+	w.Within = 10 * time.Minute
+	w.Logf = func(format string, args ...interface{}) {}
+	key := w.watch(svc)
+
+	// failures further apart than the window never add up.
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		w.check(context.Background(), key, now)
+		assert.Equal(t, key.backoff, time.Duration(0))
+		now = now.Add(6 * time.Minute)
+	}
+	assert.Equal(t, loads, 5)
+}
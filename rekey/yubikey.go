@@ -5,6 +5,10 @@ import (
 	"regexp"
 )
 
+const (
+	ykModule = "libykcs11"
+)
+
 var (
 	ykRegexp = regexp.MustCompile("libykcs11|yubico")
 )
@@ -14,13 +18,21 @@ func IsYubikey(key *agents.Key) bool {
 	return ykRegexp.MatchString(key.Comment)
 }
 
-// LoadYubikey loads the Yubikey PKCS11 lib
+// LoadYubikey loads the Yubikey PKCS11 lib, found with FindModule
 func LoadYubikey() error {
-	return LoadPKCS11("/usr/local/lib/libykcs11.dylib")
+	return ModuleLoader(ykModule, 0)()
+}
+
+// UnloadYubikey removes the Yubikey PKCS11 lib from ssh-agent
+func UnloadYubikey() error {
+	return ModuleUnloader(ykModule)()
 }
 
 // Yubikey returns a KeyEnsurer that ensures that a Yubikey SSH token is
 // availible in ssh-agent.
 func Yubikey() *KeyEnsurer {
-	return New(IsYubikey, LoadYubikey)
+	svc := New(IsYubikey, nil).Named("yubikey")
+	svc.KeyLoader = func() error { return moduleLoader(ykModule, svc.Lifetime, svc.run)() }
+	svc.KeyUnloader = moduleUnloader(ykModule, svc.run)
+	return svc
 }
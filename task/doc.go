@@ -2,6 +2,10 @@
 Package task provides building blocks for spawning processes and communicating
 with them via channels.
 
+Spawn runs a process in a PTY, which merges its stdout and stderr. Programs that
+behave differently on a terminal, like git, can be run with SpawnPipes instead,
+whose Output events say which Stream they came from.
+
 Here's an example of communicating with a simple process and reading its output.
 
 	package main
@@ -30,11 +34,11 @@ Here's an example of communicating with a simple process and reading its output.
 		// write "hello world\n" to tee's STDIN.
 		tee.Input <- []byte("hello world\n")
 
-		// start a goroutine to kill tee after a second. This is needed as tee will
+		// start a goroutine to stop tee after a second. This is needed as tee will
 		// run forever.
 		go func(t *task.Task) {
 			time.Sleep(time.Second)
-			t.Kill()
+			t.Stop(time.Second)
 		}(tee)
 
 		// Loop over tee's output channel, handling each event.
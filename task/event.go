@@ -31,17 +31,63 @@ func (e *Event) String() string {
 // exited 0, Error will be nil. Otherwise it will be an exec.ExitError.
 type Ended struct {
 	Error error
+	// By is the step that ended the process.
+	By EndedBy
 }
 
 func (p *Ended) String() string {
-	return fmt.Sprintf("%T{%v}", p, p.Error)
+	return fmt.Sprintf("%T{%v %v}", p, p.Error, p.By)
+}
+
+// EndedBy describes what ended a task's process.
+type EndedBy int
+
+const (
+	// ByExit means the process exited by itself.
+	ByExit EndedBy = iota
+	// BySignal means the process exited after Stop sent it the stop signal.
+	BySignal
+	// ByKill means the process was killed, by Kill or after Stop's grace
+	// period.
+	ByKill
+)
+
+func (b EndedBy) String() string {
+	switch b {
+	case BySignal:
+		return "signal"
+	case ByKill:
+		return "kill"
+	}
+	return "exit"
 }
 
 // Output is the type of payload indicating the process output some amount of data.
 type Output struct {
 	Chunk string
+	// Stream is where the output came from. A PTY merges stderr into stdout,
+	// so output of tasks in a PTY always comes from Stdout.
+	Stream Stream
 }
 
 func (p *Output) String() string {
-	return fmt.Sprintf("%T{%v}", p, p.Chunk)
+	return fmt.Sprintf("%T{%v: %v}", p, p.Stream, p.Chunk)
+}
+
+// Stream is an output stream of a process.
+type Stream int
+
+const (
+	// Stdout is the process's standard output, or its PTY.
+	Stdout Stream = iota
+	// Stderr is the process's standard error. Only tasks spawned with pipes
+	// have it.
+	Stderr
+)
+
+func (s Stream) String() string {
+	if s == Stderr {
+		return "stderr"
+	}
+	return "stdout"
 }
@@ -0,0 +1,76 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// SpawnPipes spawns a Cmd connected to pipes instead of a PTY, for programs
+// that behave differently on a terminal. Its stdout and stderr are split with
+// their own split functions, and emitted as Output events with the Stream they
+// came from.
+//
+// Input is written to the process's stdin, unless cmd.Stdin is set, in which
+// case Input is discarded. Set cmd.Stdin for programs that read their input
+// until EOF. See Respawn for the stdin of respawned tasks.
+func SpawnPipes(cmd *exec.Cmd, stdout, stderr bufio.SplitFunc) (*Task, error) {
+	return SpawnPipesContext(context.Background(), cmd, stdout, stderr)
+}
+
+// SpawnPipesContext spawns a Cmd connected to pipes like SpawnPipes. When ctx
+// is done, the task is stopped as if by Stop, with the task's Grace.
+func SpawnPipesContext(ctx context.Context, cmd *exec.Cmd, stdout, stderr bufio.SplitFunc) (*Task, error) {
+	return spawnPipes(ctx, cmd, stdout, stderr, DefaultStopSignal, DefaultGrace)
+}
+
+// spawnPipes spawns a Cmd connected to pipes, with the given stop signal and
+// grace.
+func spawnPipes(ctx context.Context, cmd *exec.Cmd, stdout, stderr bufio.SplitFunc, stopSignal syscall.Signal, grace time.Duration) (*Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var input io.Writer = ioutil.Discard
+	if cmd.Stdin == nil {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		input = stdin
+	}
+	outPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	errPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// run the process in its own group, so that Stop reaches its children.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	task := &Task{
+		cmd:             cmd,
+		splitFunc:       stdout,
+		stderrSplitFunc: stderr,
+		StopSignal:      stopSignal,
+		Grace:           grace,
+	}
+	start(ctx, task, input,
+		newStream(Stdout, outPipe, stdout),
+		newStream(Stderr, errPipe, stderr),
+	)
+	return task, nil
+}
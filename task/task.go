@@ -2,43 +2,128 @@ package task
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	ptylib "github.com/kr/pty"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-// Task is a running process inside a PTY. Use Spawn to create a new Task.
-// Interact with a task by reading from its Events channel, and writing to its
-// Input channel.
+// DefaultStopSignal is the signal Stop sends to a task's process group before
+// killing it.
+var DefaultStopSignal = syscall.SIGTERM
+
+// DefaultGrace is how long a task spawned with SpawnContext has to exit after
+// its context is done, before it is killed.
+const DefaultGrace = 5 * time.Second
+
+// Task is a running process inside a PTY, or connected to pipes. Use Spawn or
+// SpawnPipes to create a new Task. Interact with a task by reading from its
+// Events channel, and writing to its Input channel.
 type Task struct {
 	cmd *exec.Cmd
+	// pty is nil for tasks spawned with pipes.
 	pty *os.File
-	// Send a byte slice to this channel to write to the process's pty.
+	// Send a byte slice to this channel to write to the process's pty or
+	// stdin.
 	Input chan<- []byte
 	// Output will emit Event structs as events (like process output or process
 	// termination) occurr.
 	Output    <-chan *Event
 	splitFunc bufio.SplitFunc
+	// stderrSplitFunc splits stderr for tasks spawned with pipes.
+	stderrSplitFunc bufio.SplitFunc
+
+	// StopSignal is sent to the process group by Stop. Defaults to
+	// DefaultStopSignal.
+	StopSignal syscall.Signal
+	// Grace is how long the process has to exit after the task's context is
+	// done, before it is killed. Defaults to DefaultGrace. It is read when the
+	// context is done, so change it only while the context can't be done yet.
+	Grace time.Duration
+
+	ctx context.Context
+	// exited is closed once the process has been waited for.
+	exited chan struct{}
+
+	mu      sync.Mutex
+	endedBy EndedBy
+	// reaped is true once the process has been waited for, and its pid may
+	// belong to another process.
+	reaped bool
 }
 
 func (task *Task) String() string {
 	return fmt.Sprintf("%T{%p '%+v'}", task, task, task.cmd.Path)
 }
 
-// Kill kills the task. Returns nil if the task is not running.
+// Kill kills the task's process group immediately. Returns nil if the task is
+// not running.
 func (task *Task) Kill() error {
-	if task.cmd.Process == nil {
+	return task.signal(syscall.SIGKILL, ByKill)
+}
+
+// Stop asks the task's process group to exit by sending it StopSignal. If the
+// process is still running after grace, the group is killed. Returns nil if
+// the task is not running.
+func (task *Task) Stop(grace time.Duration) error {
+	if err := task.signal(task.StopSignal, BySignal); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-task.exited:
 		return nil
+	case <-timer.C:
+		return task.Kill()
 	}
+}
 
-	return task.cmd.Process.Kill()
+// signal sends sig to the task's process group, recording that by ended the
+// process if it exits. The process leads its own group: the PTY makes it a
+// session leader, and pipe mode sets Setpgid.
+func (task *Task) signal(sig syscall.Signal, by EndedBy) error {
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	if task.cmd.Process == nil || task.reaped {
+		return nil
+	}
+
+	task.endedBy = by
+	err := syscall.Kill(-task.cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		// the process exited, but hasn't been waited for yet.
+		return nil
+	}
+	return err
 }
 
 // Spawn a Cmd into a PTY. Returns a Task, so that you can communicate with
 // the process
 func Spawn(cmd *exec.Cmd, splitter bufio.SplitFunc) (*Task, error) {
+	return SpawnContext(context.Background(), cmd, splitter)
+}
+
+// SpawnContext spawns a Cmd into a PTY like Spawn. When ctx is done, the task
+// is stopped as if by Stop, with the task's Grace.
+func SpawnContext(ctx context.Context, cmd *exec.Cmd, splitter bufio.SplitFunc) (*Task, error) {
+	return spawnPTY(ctx, cmd, splitter, DefaultStopSignal, DefaultGrace)
+}
+
+// spawnPTY spawns a Cmd into a PTY, with the given stop signal and grace.
+func spawnPTY(ctx context.Context, cmd *exec.Cmd, splitter bufio.SplitFunc, stopSignal syscall.Signal, grace time.Duration) (*Task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	pty, err := ptylib.Start(cmd)
 	if err != nil {
 		// TODO: wrap error.
@@ -52,68 +137,141 @@ func Spawn(cmd *exec.Cmd, splitter bufio.SplitFunc) (*Task, error) {
 		return nil, err
 	}
 
-	scanner := bufio.NewScanner(pty)
+	task := &Task{
+		cmd:        cmd,
+		pty:        pty,
+		splitFunc:  splitter,
+		StopSignal: stopSignal,
+		Grace:      grace,
+	}
+	start(ctx, task, pty, newStream(Stdout, pty, splitter))
+	return task, nil
+}
+
+// stream is an output stream of a task's process, split into chunks.
+type stream struct {
+	name    Stream
+	scanner *bufio.Scanner
+}
+
+func newStream(name Stream, r io.Reader, splitter bufio.SplitFunc) *stream {
+	scanner := bufio.NewScanner(r)
 	scanner.Split(splitter)
+	return &stream{name, scanner}
+}
 
+// start fills in a Task for a started cmd, and begins relaying its input and
+// output. The task's StopSignal and Grace must be set before start, since
+// stopOnDone may read them at any time after.
+func start(ctx context.Context, task *Task, input io.Writer, streams ...*stream) {
 	fromProcess := make(chan *Event)
 	toProcess := make(chan []byte)
 
-	task := &Task{
-		cmd:       cmd,
-		pty:       pty,
-		splitFunc: splitter,
-		Input:     toProcess,
-		Output:    fromProcess,
-	}
+	task.Input = toProcess
+	task.Output = fromProcess
+	task.ctx = ctx
+	task.exited = make(chan struct{})
 
-	go emitEvents(task, scanner, fromProcess, toProcess)
-	go sendInput(pty, toProcess)
+	go stopOnDone(task)
+	go emitEvents(task, streams, fromProcess, toProcess)
+	go sendInput(input, toProcess)
+}
 
-	return task, nil
+// stopOnDone stops the task once its context is done.
+func stopOnDone(task *Task) {
+	select {
+	case <-task.exited:
+	case <-task.ctx.Done():
+		task.Stop(task.Grace)
+	}
 }
 
-// Respawn spawns a new task with a duplicate of this task's command.
+// Respawn spawns a new task with a duplicate of this task's command, in the
+// same mode, using the same context, stop signal, and grace. Fails if the
+// context is done.
+//
+// A pipe-mode task whose cmd.Stdin was set keeps it only if it is an
+// *os.File, like os.Stdin. Any other reader was drained by the first process,
+// so the respawned process reads an empty stdin, and its Input is discarded.
 func (task *Task) Respawn() (*Task, error) {
-	return Spawn(
-		&exec.Cmd{
-			Path:        task.cmd.Path,
-			Args:        task.cmd.Args,
-			Env:         task.cmd.Env,
-			Dir:         task.cmd.Dir,
-			ExtraFiles:  task.cmd.ExtraFiles,
-			SysProcAttr: task.cmd.SysProcAttr,
-		},
-		task.splitFunc,
-	)
-}
-
-func emitEvents(task *Task, scanner *bufio.Scanner, out chan<- *Event, closeOnEnd chan []byte) {
-	for scanner.Scan() {
-		output := &Output{scanner.Text()}
-		out <- &Event{task, output}
+	cmd := &exec.Cmd{
+		Path:        task.cmd.Path,
+		Args:        task.cmd.Args,
+		Env:         task.cmd.Env,
+		Dir:         task.cmd.Dir,
+		ExtraFiles:  task.cmd.ExtraFiles,
+		SysProcAttr: task.cmd.SysProcAttr,
 	}
 
-	if err := scanner.Err(); err != nil {
-		// TODO: something more sensible than panic
-		// send error on the channel?
-		panic(err)
+	if task.pty == nil {
+		switch stdin := task.cmd.Stdin.(type) {
+		case nil, *os.File:
+			cmd.Stdin = stdin
+		default:
+			cmd.Stdin = strings.NewReader("")
+		}
+		return spawnPipes(task.ctx, cmd, task.splitFunc, task.stderrSplitFunc, task.StopSignal, task.Grace)
 	}
+	return spawnPTY(task.ctx, cmd, task.splitFunc, task.StopSignal, task.Grace)
+}
+
+func emitEvents(task *Task, streams []*stream, out chan<- *Event, closeOnEnd chan []byte) {
+	var reading sync.WaitGroup
+	for _, s := range streams {
+		reading.Add(1)
+		go func(s *stream) {
+			defer reading.Done()
+			emitOutput(task, s, out)
+		}(s)
+	}
+	// the process's output must be read before it is waited for.
+	reading.Wait()
 
 	exit := task.cmd.Wait()
+	if task.pty != nil {
+		task.pty.Close()
+	}
+	task.mu.Lock()
+	task.reaped = true
+	by := task.endedBy
+	task.mu.Unlock()
+	close(task.exited)
 	// TODO: should this be last, and go after the send?
 	close(closeOnEnd)
 
-	out <- &Event{task, &Ended{exit}}
+	out <- &Event{task, &Ended{Error: exit, By: by}}
 	close(out)
 }
 
-func sendInput(pty *os.File, in <-chan []byte) {
+func emitOutput(task *Task, s *stream, out chan<- *Event) {
+	for s.scanner.Scan() {
+		output := &Output{Chunk: s.scanner.Text(), Stream: s.name}
+		out <- &Event{task, output}
+	}
+
+	// reading a PTY fails with EIO on Linux once the process has exited.
+	if err := s.scanner.Err(); err != nil && !isEIO(err) {
+		// TODO: something more sensible than panic
+		// send error on the channel?
+		panic(err)
+	}
+}
+
+func isEIO(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.EIO
+}
+
+func sendInput(w io.Writer, in <-chan []byte) {
+	failed := false
 	for input := range in {
-		_, err := pty.Write(input)
-		if err != nil {
-			// TODO: something more sensible than panic
-			// TODO: can we always write? What if the process is dead and the PTY closes??
-			panic(err)
+		if failed {
+			continue
 		}
+		// writes fail once the process exits or closes its stdin; the rest of
+		// the input is dropped.
+		// TODO: report the error as an event?
+		_, err := w.Write(input)
+		failed = err != nil
 	}
 }
@@ -0,0 +1,117 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"github.com/justjake/encabulator/assert"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ended reads events from t until it ends.
+func ended(t *Task) *Ended {
+	for event := range t.Output {
+		if payload, ok := event.Payload.(*Ended); ok {
+			return payload
+		}
+	}
+	return nil
+}
+
+func TestTask_Stop(t *testing.T) {
+	sleep, err := Spawn(exec.Command("sleep", "60"), bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	go sleep.Stop(time.Minute)
+	assert.Equal(t, ended(sleep).By, BySignal)
+
+	// the shell ignores SIGTERM, so it's killed after the grace period.
+	stubborn, err := Spawn(exec.Command("sh", "-c", "trap '' TERM; echo ready; sleep 60"), bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	event := <-stubborn.Output
+	assert.Equal(t, event.Payload.(*Output).Chunk, "ready")
+	go stubborn.Stop(100 * time.Millisecond)
+	assert.Equal(t, ended(stubborn).By, ByKill)
+
+	echo, err := Spawn(exec.Command("echo", "hi"), bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ended(echo).By, ByExit)
+	assert.Equal(t, echo.Stop(time.Second), nil)
+}
+
+func TestSpawnContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sleep, err := SpawnContext(ctx, exec.Command("sleep", "60"), bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	cancel()
+	assert.Equal(t, ended(sleep).By, BySignal)
+
+	_, err = sleep.Respawn()
+	assert.Equal(t, err, context.Canceled)
+}
+
+func TestTask_RespawnKeepsStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleep, err := SpawnContext(ctx, exec.Command("sleep", "60"), bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	sleep.StopSignal = syscall.SIGINT
+	sleep.Grace = time.Minute
+	go sleep.Kill()
+	assert.Equal(t, ended(sleep).By, ByKill)
+
+	respawned, err := sleep.Respawn()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, respawned.StopSignal, syscall.SIGINT)
+	assert.Equal(t, respawned.Grace, time.Minute)
+	cancel()
+	assert.Equal(t, ended(respawned).By, BySignal)
+}
+
+func TestSpawnPipes(t *testing.T) {
+	script := "echo out; echo err 1>&2; read line; echo \"got $line\""
+	sh, err := SpawnPipes(exec.Command("sh", "-c", script), bufio.ScanLines, bufio.ScanWords)
+	assert.Equal(t, err, nil)
+	sh.Input <- []byte("a line\n")
+
+	stdout := []string{}
+	stderr := []string{}
+	var end *Ended
+	for event := range sh.Output {
+		switch payload := event.Payload.(type) {
+		case *Output:
+			if payload.Stream == Stderr {
+				stderr = append(stderr, payload.Chunk)
+			} else {
+				stdout = append(stdout, payload.Chunk)
+			}
+		case *Ended:
+			end = payload
+		}
+	}
+	assert.Equal(t, stdout, []string{"out", "got a line"})
+	assert.Equal(t, stderr, []string{"err"})
+	assert.Equal(t, end.Error, nil)
+
+	// a drained stdin isn't read again.
+	cmd := exec.Command("cat")
+	cmd.Stdin = strings.NewReader("once\n")
+	cat, err := SpawnPipes(cmd, bufio.ScanLines, bufio.ScanLines)
+	assert.Equal(t, err, nil)
+	event := <-cat.Output
+	assert.Equal(t, event.Payload.(*Output).Chunk, "once")
+	assert.Equal(t, ended(cat).Error, nil)
+	cat, err = cat.Respawn()
+	assert.Equal(t, err, nil)
+	event = <-cat.Output
+	assert.Equal(t, event.Payload.(*Ended).Error, nil)
+
+	// respawned tasks use pipes too.
+	respawned, err := sh.Respawn()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, respawned.pty == nil, true)
+	go respawned.Stop(time.Minute)
+	assert.Equal(t, ended(respawned).By, BySignal)
+}
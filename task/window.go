@@ -0,0 +1,46 @@
+package task
+
+import (
+	"time"
+)
+
+// FailureWindow counts failures within a sliding window of time, like a
+// Supervisor does for Tasks. Use it to stop retrying things other than Tasks
+// that keep failing.
+type FailureWindow struct {
+	maxFailures int
+	duration    time.Duration
+	failures    []time.Time
+}
+
+// MakeFailureWindow returns a FailureWindow that allows maxFailures within
+// any period of the given duration.
+func MakeFailureWindow(maxFailures int, within time.Duration) *FailureWindow {
+	return &FailureWindow{
+		maxFailures,
+		within,
+		make([]time.Time, 0, maxFailures+1),
+	}
+}
+
+// Fail records a failure that happened at now. Returns true if there have been
+// more than maxFailures failures within the window.
+func (w *FailureWindow) Fail(now time.Time) bool {
+	w.failures = append(w.failures, now)
+
+	// forget failures that have left the window.
+	recent := w.failures[:0]
+	for _, t := range w.failures {
+		if now.Sub(t) < w.duration {
+			recent = append(recent, t)
+		}
+	}
+	w.failures = recent
+
+	return len(w.failures) > w.maxFailures
+}
+
+// Zero forgets all failures.
+func (w *FailureWindow) Zero() {
+	w.failures = w.failures[:0]
+}